@@ -0,0 +1,72 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/handlers"
+	"github.com/spf13/cobra"
+)
+
+var binCmd = &cobra.Command{
+	Use:   "bin",
+	Short: "Serve httpbin-compatible endpoints",
+	Long: `Start the HTTP server that will implement the common httpbin endpoints, such as /status/{code}, /delay/{n},
+/bytes/{n}, /stream/{n}, /redirect/{n}, /headers, /anything, /gzip and /basic-auth/{user}/{passwd},
+and log the incoming HTTP requests to the standard output.`,
+	Run: executeBin,
+}
+
+func init() {
+	RootCmd.AddCommand(binCmd)
+
+	ctx := context.Instance()
+
+	binCmd.Flags().BoolVarP(&ctx.LogJSON, "json", "j", false, "Log HTTP requests in JSON format")
+	binCmd.Flags().BoolVarP(&ctx.LogPrettyJSON, "json-pp", "p", false, "Log HTTP requests in pretty-printed (indented) JSON format")
+	binCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, when replying to incoming HTTP requests")
+	binCmd.Flags().StringVarP(&ctx.BinPrefix, "prefix", "", "", "Mount the endpoints under the path prefix, e.g. /bin")
+}
+
+func executeBin(cmd *cobra.Command, args []string) {
+	ctx := context.Instance()
+
+	h := setupBinHandlerChain(ctx)
+
+	http.Handle("/", h)
+
+	// Start the HTTP server and handle the command
+	ctx.StartServer()
+
+	ctx.Close()
+}
+
+func setupBinHandlerChain(ctx *context.Context) http.Handler {
+	var h http.Handler
+	{
+		h = handlers.BinHandler(ctx, nil)
+
+		h = handlers.DelayHandler(ctx, h)
+
+		if ctx.LogJSON || ctx.LogPrettyJSON {
+			h = handlers.JSONRequestLoggingHandler(ctx, h)
+		} else {
+			h = handlers.RawRequestLoggingHandler(ctx, h)
+		}
+	}
+
+	return h
+}
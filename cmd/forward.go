@@ -0,0 +1,83 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/handlers"
+	"github.com/spf13/cobra"
+)
+
+var forwardProxyCmd = &cobra.Command{
+	Use:   "forward-proxy",
+	Short: "Act as an explicit HTTP proxy.",
+	Long: `Start the HTTP server that will act as an explicit HTTP proxy, forwarding absolute-URI requests
+and tunneling CONNECT requests to their destinations, and log the incoming HTTP requests to the standard output.
+Point the HTTP_PROXY and HTTPS_PROXY environment variables of the client at the server address.
+See options to modify the behavior per destination host.`,
+	Run: executeForwardProxy,
+}
+
+func init() {
+	RootCmd.AddCommand(forwardProxyCmd)
+
+	ctx := context.Instance()
+
+	forwardProxyCmd.Flags().BoolVarP(&ctx.LogJSON, "json", "j", false, "Log HTTP requests in JSON format")
+	forwardProxyCmd.Flags().BoolVarP(&ctx.LogPrettyJSON, "json-pp", "p", false, "Log HTTP requests in pretty-printed (indented) JSON format")
+	forwardProxyCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, before forwarding requests to any destination host")
+	forwardProxyCmd.Flags().StringToIntVarP(&ctx.ForwardProxy.HostDelays, "host-delay", "", nil, "Delay, in milliseconds, before forwarding requests to the destination hosts, e.g. api.example.com=500")
+	forwardProxyCmd.Flags().BoolVarP(&ctx.FailureMode.Enabled, "simulate-failure", "f", false, "Simulate a transient failure: return an error code before forwarding the request, tracked per destination host")
+	forwardProxyCmd.Flags().StringSliceVarP(&ctx.ForwardProxy.FailHosts, "simulate-failure-hosts", "", nil, "For --simulate-failure, limits the failure simulation to the destination hosts. If blank, failures apply to every host")
+	forwardProxyCmd.Flags().IntVarP(&ctx.FailureMode.FailureCount, "simulate-failure-count", "", 1, "For --simulate-failure, determines how many errors are returned before forwarding the request")
+	forwardProxyCmd.Flags().IntVarP(&ctx.FailureMode.SuccessCount, "simulate-success-count", "", 1, "For --simulate-failure, determines how many requests are forwarded before returning a error code")
+	forwardProxyCmd.Flags().IntVarP(&ctx.FailureMode.FailureCode, "simulate-failure-code", "", 500, "For --simulate-failure, determines the HTTP status code for an error response")
+	forwardProxyCmd.Flags().BoolVarP(&ctx.IgnoreTLSErrors, "insecure", "k", false, "Ignore destination TLS certificate errors")
+	forwardProxyCmd.Flags().BoolVarP(&ctx.LogResponses, "log-responses", "", false, "For --intercept, also log the decrypted responses")
+	forwardProxyCmd.Flags().BoolVarP(&ctx.ForwardProxy.Intercept, "intercept", "", false, "Decrypt and log the HTTPS traffic tunneled by CONNECT requests, using certificates issued by the local CA in --tls-ca-dir")
+}
+
+func executeForwardProxy(cmd *cobra.Command, args []string) {
+	ctx := context.Instance()
+
+	if ctx.ForwardProxy.Intercept && len(ctx.CADir) == 0 {
+		log.Fatal("--intercept requires a local CA: set --tls-ca-dir")
+	}
+
+	// The ServeMux rejects CONNECT requests: serve every request with the proxy handler chain
+	ctx.Handler = setupForwardProxyHandlerChain(ctx)
+
+	// Start the HTTP server and handle the command
+	ctx.StartServer()
+
+	ctx.Close()
+}
+
+func setupForwardProxyHandlerChain(ctx *context.Context) http.Handler {
+	var h http.Handler
+	{
+		h = handlers.ForwardProxyHandler(ctx, nil)
+
+		if ctx.LogJSON || ctx.LogPrettyJSON {
+			h = handlers.JSONRequestLoggingHandler(ctx, h)
+		} else {
+			h = handlers.RawRequestLoggingHandler(ctx, h)
+		}
+	}
+
+	return h
+}
@@ -0,0 +1,114 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/handlers"
+	"github.com/netbucket/httpr/openapi"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var inferCmd = &cobra.Command{
+	Use:   "infer [json-log-file...]",
+	Short: "Infer an OpenAPI specification from the captured requests.",
+	Long: `Read the requests and responses captured in JSON format by httpr, e.g. with httpr proxy -j --log-responses,
+from the files or the standard input, and write a draft OpenAPI 3 specification describing them: the paths with the
+inferred parameters, the methods, the query parameters, and the JSON schemas and status codes of the requests and responses.`,
+	Run: executeInfer,
+}
+
+func init() {
+	RootCmd.AddCommand(inferCmd)
+
+	ctx := context.Instance()
+
+	inferCmd.Flags().StringVarP(&ctx.Infer.Title, "title", "", "Inferred API", "Title of the API")
+	inferCmd.Flags().StringVarP(&ctx.Infer.OutputFile, "output", "o", "", "Write the specification to the specified file instead of the standard output")
+	inferCmd.Flags().BoolVarP(&ctx.Infer.JSON, "json", "j", false, "Write the specification in JSON format instead of YAML")
+}
+
+func executeInfer(cmd *cobra.Command, args []string) {
+	ctx := context.Instance()
+
+	var exchanges []openapi.Exchange
+
+	if len(args) == 0 {
+		exchanges = readTraffic(os.Stdin)
+	}
+
+	for _, fileName := range args {
+		f, err := os.Open(fileName)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		exchanges = append(exchanges, readTraffic(f)...)
+
+		f.Close()
+	}
+
+	if len(exchanges) == 0 {
+		log.Fatal("No requests were found in the JSON log")
+	}
+
+	doc := openapi.Infer(ctx.Infer.Title, exchanges)
+
+	var buf bytes.Buffer
+	var err error
+
+	if ctx.Infer.JSON {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(doc)
+	} else {
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err = enc.Encode(doc)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(ctx.Infer.OutputFile) > 0 {
+		err = ioutil.WriteFile(ctx.Infer.OutputFile, buf.Bytes(), 0644)
+	} else {
+		_, err = ctx.Out.Write(buf.Bytes())
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readTraffic reads the requests and responses of the JSON log
+func readTraffic(r io.Reader) []openapi.Exchange {
+	exchanges, err := handlers.ReadTraffic(r)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return exchanges
+}
@@ -14,6 +14,7 @@
 package cmd
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/netbucket/httpr/context"
@@ -37,17 +38,63 @@ func init() {
 	logCmd.Flags().BoolVarP(&ctx.LogJSON, "json", "j", false, "Log HTTP requests in JSON format")
 	logCmd.Flags().BoolVarP(&ctx.LogPrettyJSON, "json-pp", "p", false, "Log HTTP requests in pretty-printed (indented) JSON format")
 	logCmd.Flags().BoolVarP(&ctx.Echo, "echo", "e", false, "Send the logged contents back to the HTTP client")
+	logCmd.Flags().StringVarP(&ctx.ResponseBody, "response-body", "b", "", "Send the specified response body, rendered as a Go text/template, back to the client")
+	logCmd.Flags().StringVarP(&ctx.ResponseTemplateFile, "response-template", "", "", "Send the response body rendered from the specified Go text/template file back to the client")
+	logCmd.Flags().StringVarP(&ctx.Stream.Mode, "stream", "", "", "Stream the response back to the client: sse (Server-Sent Events) or chunked")
+	logCmd.Flags().IntVarP(&ctx.Stream.Count, "stream-count", "", 10, "For --stream, determines how many events or chunks are sent (0 streams indefinitely)")
+	logCmd.Flags().IntVarP(&ctx.Stream.Interval, "stream-interval", "", 1000, "For --stream, determines the interval, in milliseconds, between events or chunks")
+	logCmd.Flags().StringVarP(&ctx.Stream.Data, "stream-data", "", "event {{.ID}}", "For --stream, determines the event or chunk data, rendered as a Go text/template")
+	logCmd.Flags().StringVarP(&ctx.Stream.EventName, "stream-event", "", "", "For --stream=sse, determines the event name")
+	logCmd.Flags().IntVarP(&ctx.Stream.DisconnectAfter, "stream-disconnect-after", "", 0, "For --stream, abort the connection after the specified number of events or chunks (0 disables)")
 	logCmd.Flags().IntVarP(&ctx.HttpCode, "response-code", "r", 200, "Send the specified HTTP status code back to the client")
 	logCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, when replying to incoming HTTP requests")
+	logCmd.Flags().BoolVarP(&ctx.DisableOverrides, "disable-overrides", "", false, "Ignore the X-Httpr-Status, X-Httpr-Delay, X-Httpr-Fail and X-Httpr-Body request headers overriding the behavior for a single request")
+	logCmd.Flags().IntVarP(&ctx.WebSocket.FrameDelay, "ws-frame-delay", "", 0, "Delay, in milliseconds, before relaying each WebSocket data frame")
+	logCmd.Flags().IntVarP(&ctx.WebSocket.CloseAfter, "ws-close-after", "", 0, "Close WebSocket connections after the specified number of data frames (0 disables)")
+	logCmd.Flags().IntVarP(&ctx.WebSocket.CloseCode, "ws-close-code", "", 1011, "For --ws-close-after, determines the WebSocket close code (0 closes the connection abruptly)")
+	logCmd.Flags().IntVarP(&ctx.WebSocket.MaxFrameSize, "ws-max-frame-size", "", handlers.DefaultWebSocketMaxFrameSize, "Maximum WebSocket frame payload, in bytes: connections sending larger frames are closed with the 1009 close code")
 	logCmd.Flags().BoolVarP(&ctx.FailureMode.Enabled, "simulate-failure", "f", false, "Simulate a transient failure: return an error code before a successful response")
 	logCmd.Flags().IntVarP(&ctx.FailureMode.FailureCount, "simulate-failure-count", "", 1, "For --simulate-failure, determines how many errors are returned before a successful response")
 	logCmd.Flags().IntVarP(&ctx.FailureMode.SuccessCount, "simulate-success-count", "", 1, "For --simulate-failure, determines how many successful responses are returned before returning a error code")
 	logCmd.Flags().IntVarP(&ctx.FailureMode.FailureCode, "simulate-failure-code", "", 500, "For --simulate-failure, determines the HTTP status code for an error response")
+	logCmd.Flags().VarP(&ctx.FailureMode.Sequence, "simulate-sequence", "", "Script the exact responses, e.g. 503,503,timeout,200x5,429(retry-after=2),reset. The sequence loops, unless the last step repeats forever, e.g. 503x2,200x*")
+	logCmd.Flags().StringVarP(&ctx.FailureMode.Key, "simulate-failure-key", "", "global", "For --simulate-failure and --simulate-sequence, track the failures independently per key: global, ip, path, api-key, idempotency-key or header:<name>")
+	logCmd.Flags().IntVarP(&ctx.FailureMode.KeyExpiry, "simulate-failure-key-expiry", "", 300, "For --simulate-failure-key, restart the failures of keys idle for the specified number of seconds (0 disables)")
+	logCmd.Flags().IntVarP(&ctx.GRPCStatus, "grpc-status", "", 0, "Send the specified gRPC status code back to gRPC clients")
+	logCmd.Flags().IntVarP(&ctx.FailureMode.GRPCStatus, "simulate-failure-grpc-status", "", 14, "For --simulate-failure, determines the gRPC status code returned to gRPC clients (14 is UNAVAILABLE)")
+	logCmd.Flags().IntVarP(&ctx.RateLimit.Limit, "rate-limit", "", 0, "Simulate rate limiting: allow the specified number of requests per window, and reply 429 Too Many Requests to the rest (0 disables)")
+	logCmd.Flags().IntVarP(&ctx.RateLimit.Window, "rate-limit-window", "", 60, "For --rate-limit, determines the window length, in seconds")
+	logCmd.Flags().StringVarP(&ctx.RateLimit.Algorithm, "rate-limit-algorithm", "", "fixed-window", "For --rate-limit, determines the algorithm: fixed-window, sliding-window or token-bucket")
+	logCmd.Flags().StringVarP(&ctx.RateLimit.Key, "rate-limit-key", "", "global", "For --rate-limit, determines what requests are counted against: global, ip, path, api-key, idempotency-key or header:<name>")
+	logCmd.Flags().StringVarP(&ctx.Validation.OpenAPIFile, "validate-openapi", "", "", "Validate the requests against the specified OpenAPI 3 document, and log the validation errors")
+	logCmd.Flags().StringToStringVarP(&ctx.Validation.Schemas, "validate-schema", "", nil, "Validate the JSON request bodies of a route against a JSON Schema file, e.g. \"POST /orders=order.schema.json\"")
+	logCmd.Flags().BoolVarP(&ctx.Validation.Reject, "validate-reject", "", false, "For --validate-openapi and --validate-schema, reject the invalid requests with a 400 error")
+	logCmd.Flags().StringVarP(&ctx.Validation.ErrorBody, "validate-error-body", "", "", "For --validate-reject, determines the error body, rendered as a Go text/template with .Method, .Path and .Errors")
 }
 
 func executeLog(cmd *cobra.Command, args []string) {
 	ctx := context.Instance()
 
+	if len(ctx.Stream.Mode) > 0 && ctx.Stream.Mode != handlers.StreamSSE && ctx.Stream.Mode != handlers.StreamChunked {
+		log.Fatalf("Unsupported stream mode: %s", ctx.Stream.Mode)
+	}
+
+	if ctx.RateLimit.Enabled() {
+		if err := ctx.RateLimit.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := context.ValidateRequestKey(ctx.FailureMode.Key); err != nil {
+		log.Fatal(err)
+	}
+
+	if ctx.Validation.Enabled() {
+		if err := ctx.Validation.Load(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	h := setupLogHandlerChain(ctx)
 
 	http.Handle("/", h)
@@ -61,7 +108,15 @@ func executeLog(cmd *cobra.Command, args []string) {
 func setupLogHandlerChain(ctx *context.Context) http.Handler {
 	var h http.Handler
 	{
-		h = handlers.DelayHandler(ctx, nil)
+		if len(ctx.Stream.Mode) > 0 {
+			h = handlers.StreamHandler(ctx, nil)
+		}
+
+		h = handlers.DelayHandler(ctx, h)
+
+		if len(ctx.ResponseBody) > 0 || len(ctx.ResponseTemplateFile) > 0 || !ctx.DisableOverrides {
+			h = handlers.ResponseTemplateHandler(ctx, h)
+		}
 
 		if ctx.LogJSON || ctx.LogPrettyJSON {
 			h = handlers.JSONRequestLoggingHandler(ctx, h)
@@ -69,13 +124,28 @@ func setupLogHandlerChain(ctx *context.Context) http.Handler {
 			h = handlers.RawRequestLoggingHandler(ctx, h)
 		}
 
-		if ctx.FailureMode.Enabled {
+		if ctx.FailureSimulationEnabled() || !ctx.DisableOverrides {
 			h = handlers.FailureSimulationHandler(ctx, h)
 		} else {
 			h = handlers.ResponseCodeHandler(ctx, h)
 		}
 
 		h = handlers.ContentTypeHandler(ctx, h)
+
+		// The upgrades are subject to the rate limit, the overrides and the validation
+		h = handlers.WebSocketEchoHandler(ctx, h)
+
+		if ctx.Validation.Enabled() {
+			h = handlers.ValidationHandler(ctx, h)
+		}
+
+		if !ctx.DisableOverrides {
+			h = handlers.OverrideHandler(ctx, h)
+		}
+
+		if ctx.RateLimit.Enabled() {
+			h = handlers.RateLimitHandler(ctx, h)
+		}
 	}
 
 	return h
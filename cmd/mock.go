@@ -0,0 +1,132 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/handlers"
+	"github.com/netbucket/httpr/openapi"
+	"github.com/spf13/cobra"
+)
+
+var mockCmd = &cobra.Command{
+	Use:   "mock",
+	Short: "Mock an API described by an OpenAPI specification or stateful scenarios.",
+	Long: `Start the HTTP server that will route the requests by the paths and methods of the OpenAPI specification,
+reply with the example or schema-generated responses, and log the incoming HTTP requests to the standard output.
+The Prefer: code=<status> request header selects one of the declared responses. With --scenarios, the requests are first
+matched against the rules of the stateful scenarios, whose states are listed at /__httpr/scenarios, set with
+PUT /__httpr/scenarios/{name}/state and reset with POST /__httpr/scenarios/reset.
+See options to modify the HTTP response behavior.`,
+	Run: executeMock,
+}
+
+func init() {
+	RootCmd.AddCommand(mockCmd)
+
+	ctx := context.Instance()
+
+	mockCmd.Flags().StringVarP(&ctx.OpenAPIFile, "openapi", "", "", "OpenAPI 3 specification file name, in YAML or JSON format")
+	mockCmd.Flags().StringVarP(&ctx.ScenariosFile, "scenarios", "", "", "Stateful scenarios file name, in YAML or JSON format. The scenario rules take precedence over the OpenAPI specification")
+	mockCmd.Flags().BoolVarP(&ctx.LogJSON, "json", "j", false, "Log HTTP requests in JSON format")
+	mockCmd.Flags().BoolVarP(&ctx.LogPrettyJSON, "json-pp", "p", false, "Log HTTP requests in pretty-printed (indented) JSON format")
+	mockCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, when replying to incoming HTTP requests")
+	mockCmd.Flags().BoolVarP(&ctx.DisableOverrides, "disable-overrides", "", false, "Ignore the X-Httpr-Delay and X-Httpr-Fail request headers overriding the behavior for a single request")
+	mockCmd.Flags().BoolVarP(&ctx.FailureMode.Enabled, "simulate-failure", "f", false, "Simulate a transient failure: return an error code before a mock response")
+	mockCmd.Flags().IntVarP(&ctx.FailureMode.FailureCount, "simulate-failure-count", "", 1, "For --simulate-failure, determines how many errors are returned before a mock response")
+	mockCmd.Flags().IntVarP(&ctx.FailureMode.SuccessCount, "simulate-success-count", "", 1, "For --simulate-failure, determines how many mock responses are returned before returning a error code")
+	mockCmd.Flags().IntVarP(&ctx.FailureMode.FailureCode, "simulate-failure-code", "", 500, "For --simulate-failure, determines the HTTP status code for an error response")
+	mockCmd.Flags().VarP(&ctx.FailureMode.Sequence, "simulate-sequence", "", "Script the exact responses, e.g. 503,503,timeout,200x5,429(retry-after=2),reset. The sequence loops, unless the last step repeats forever, e.g. 503x2,200x*")
+	mockCmd.Flags().StringVarP(&ctx.FailureMode.Key, "simulate-failure-key", "", "global", "For --simulate-failure and --simulate-sequence, track the failures independently per key: global, ip, path, api-key, idempotency-key or header:<name>")
+	mockCmd.Flags().IntVarP(&ctx.FailureMode.KeyExpiry, "simulate-failure-key-expiry", "", 300, "For --simulate-failure-key, restart the failures of keys idle for the specified number of seconds (0 disables)")
+}
+
+func executeMock(cmd *cobra.Command, args []string) {
+	ctx := context.Instance()
+
+	if len(ctx.OpenAPIFile) == 0 && len(ctx.ScenariosFile) == 0 {
+		log.Fatal("OpenAPI specification missing: set --openapi or --scenarios")
+	}
+
+	if len(ctx.OpenAPIFile) > 0 {
+		doc, err := openapi.Load(ctx.OpenAPIFile)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.OpenAPI = doc
+	}
+
+	if len(ctx.ScenariosFile) > 0 {
+		scenarios, err := context.LoadScenarios(ctx.ScenariosFile)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx.Scenarios = scenarios
+	}
+
+	if err := context.ValidateRequestKey(ctx.FailureMode.Key); err != nil {
+		log.Fatal(err)
+	}
+
+	h := setupMockHandlerChain(ctx)
+
+	http.Handle("/", h)
+
+	// Start the HTTP server and handle the command
+	ctx.StartServer()
+
+	ctx.Close()
+}
+
+func setupMockHandlerChain(ctx *context.Context) http.Handler {
+	var h http.Handler
+	{
+		if ctx.OpenAPI != nil {
+			h = handlers.MockHandler(ctx, nil)
+		}
+
+		if len(ctx.Scenarios) > 0 {
+			h = handlers.ScenarioHandler(ctx, h)
+		}
+
+		h = handlers.DelayHandler(ctx, h)
+
+		if ctx.LogJSON || ctx.LogPrettyJSON {
+			h = handlers.JSONRequestLoggingHandler(ctx, h)
+		} else {
+			h = handlers.RawRequestLoggingHandler(ctx, h)
+		}
+
+		if ctx.FailureSimulationEnabled() || !ctx.DisableOverrides {
+			h = handlers.FailureSimulationHandler(ctx, h)
+		}
+
+		if !ctx.DisableOverrides {
+			h = handlers.OverrideHandler(ctx, h)
+		}
+
+		if len(ctx.Scenarios) > 0 {
+			h = handlers.ScenarioAdminHandler(ctx, h)
+		}
+	}
+
+	return h
+}
@@ -39,11 +39,34 @@ func init() {
 
 	proxyCmd.Flags().BoolVarP(&ctx.LogJSON, "json", "j", false, "Log HTTP requests in JSON format")
 	proxyCmd.Flags().BoolVarP(&ctx.LogPrettyJSON, "json-pp", "p", false, "Log HTTP requests in pretty-printed (indented) JSON format")
+	proxyCmd.Flags().BoolVarP(&ctx.LogResponses, "log-responses", "", false, "Also log the upstream responses, e.g. to infer their schemas with httpr infer")
 	proxyCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, when replying to incoming HTTP requests")
+	proxyCmd.Flags().BoolVarP(&ctx.DisableOverrides, "disable-overrides", "", false, "Ignore the X-Httpr-Delay and X-Httpr-Fail request headers overriding the behavior for a single request")
+	proxyCmd.Flags().IntVarP(&ctx.WebSocket.FrameDelay, "ws-frame-delay", "", 0, "Delay, in milliseconds, before relaying each WebSocket data frame")
+	proxyCmd.Flags().IntVarP(&ctx.WebSocket.CloseAfter, "ws-close-after", "", 0, "Close WebSocket connections after the specified number of data frames (0 disables)")
+	proxyCmd.Flags().IntVarP(&ctx.WebSocket.CloseCode, "ws-close-code", "", 1011, "For --ws-close-after, determines the WebSocket close code (0 closes the connection abruptly)")
+	proxyCmd.Flags().IntVarP(&ctx.WebSocket.MaxFrameSize, "ws-max-frame-size", "", handlers.DefaultWebSocketMaxFrameSize, "Maximum WebSocket frame payload, in bytes: connections sending larger frames are closed with the 1009 close code")
 	proxyCmd.Flags().BoolVarP(&ctx.FailureMode.Enabled, "simulate-failure", "f", false, "Simulate a transient failure: return an error code before proxying the request upstream")
 	proxyCmd.Flags().IntVarP(&ctx.FailureMode.FailureCount, "simulate-failure-count", "", 1, "For --simulate-failure, determines how many errors are returned before proxying the request upstream")
 	proxyCmd.Flags().IntVarP(&ctx.FailureMode.FailureCode, "simulate-failure-code", "", 500, "For --simulate-failure, determines the HTTP status code for an error response")
+	proxyCmd.Flags().VarP(&ctx.FailureMode.Sequence, "simulate-sequence", "", "Script the exact responses, e.g. 503,503,timeout,200x5,429(retry-after=2),reset. The sequence loops, unless the last step repeats forever, e.g. 503x2,200x*")
+	proxyCmd.Flags().StringVarP(&ctx.FailureMode.Key, "simulate-failure-key", "", "global", "For --simulate-failure and --simulate-sequence, track the failures independently per key: global, ip, path, api-key, idempotency-key or header:<name>")
+	proxyCmd.Flags().IntVarP(&ctx.FailureMode.KeyExpiry, "simulate-failure-key-expiry", "", 300, "For --simulate-failure-key, restart the failures of keys idle for the specified number of seconds (0 disables)")
+	proxyCmd.Flags().IntVarP(&ctx.FailureMode.GRPCStatus, "simulate-failure-grpc-status", "", 14, "For --simulate-failure, determines the gRPC status code returned to gRPC clients (14 is UNAVAILABLE)")
+	proxyCmd.Flags().IntVarP(&ctx.RateLimit.Limit, "rate-limit", "", 0, "Simulate rate limiting: allow the specified number of requests per window, and reply 429 Too Many Requests to the rest (0 disables)")
+	proxyCmd.Flags().IntVarP(&ctx.RateLimit.Window, "rate-limit-window", "", 60, "For --rate-limit, determines the window length, in seconds")
+	proxyCmd.Flags().StringVarP(&ctx.RateLimit.Algorithm, "rate-limit-algorithm", "", "fixed-window", "For --rate-limit, determines the algorithm: fixed-window, sliding-window or token-bucket")
+	proxyCmd.Flags().StringVarP(&ctx.RateLimit.Key, "rate-limit-key", "", "global", "For --rate-limit, determines what requests are counted against: global, ip, path, api-key, idempotency-key or header:<name>")
+	proxyCmd.Flags().StringVarP(&ctx.Validation.OpenAPIFile, "validate-openapi", "", "", "Validate the requests against the specified OpenAPI 3 document, and log the validation errors")
+	proxyCmd.Flags().StringToStringVarP(&ctx.Validation.Schemas, "validate-schema", "", nil, "Validate the JSON request bodies of a route against a JSON Schema file, e.g. \"POST /orders=order.schema.json\"")
+	proxyCmd.Flags().BoolVarP(&ctx.Validation.Reject, "validate-reject", "", false, "For --validate-openapi and --validate-schema, reject the invalid requests with a 400 error")
+	proxyCmd.Flags().StringVarP(&ctx.Validation.ErrorBody, "validate-error-body", "", "", "For --validate-reject, determines the error body, rendered as a Go text/template with .Method, .Path and .Errors")
 	proxyCmd.Flags().BoolVarP(&ctx.IgnoreTLSErrors, "insecure", "k", false, "Ignore upstream TLS certificate errors")
+	proxyCmd.Flags().StringVarP(&ctx.Upstream.CertFile, "upstream-cert-file", "", "", "Client certificate file name presented to the upstream server")
+	proxyCmd.Flags().StringVarP(&ctx.Upstream.KeyFile, "upstream-key-file", "", "", "Client private key file name presented to the upstream server")
+	proxyCmd.Flags().StringVarP(&ctx.Upstream.CAFile, "upstream-ca", "", "", "CA certificate bundle file name used to verify the upstream server certificate")
+	proxyCmd.Flags().StringVarP(&ctx.Upstream.ServerName, "upstream-server-name", "", "", "Override the SNI server name sent to the upstream server")
+	proxyCmd.Flags().StringVarP(&ctx.Upstream.Protocol, "upstream-http", "", "", "Force the HTTP version used with the upstream server: 1.1, 2 or h2c (cleartext HTTP/2)")
 }
 
 func executeProxy(cmd *cobra.Command, args []string) {
@@ -62,6 +85,22 @@ func executeProxy(cmd *cobra.Command, args []string) {
 
 	ctx.UpstreamURL = u
 
+	if ctx.RateLimit.Enabled() {
+		if err := ctx.RateLimit.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := context.ValidateRequestKey(ctx.FailureMode.Key); err != nil {
+		log.Fatal(err)
+	}
+
+	if ctx.Validation.Enabled() {
+		if err := ctx.Validation.Load(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	h := setupProxyHandlerChain(ctx)
 
 	http.Handle("/", h)
@@ -85,9 +124,24 @@ func setupProxyHandlerChain(ctx *context.Context) http.Handler {
 			h = handlers.RawRequestLoggingHandler(ctx, h)
 		}
 
-		if ctx.FailureMode.Enabled {
+		if ctx.FailureSimulationEnabled() || !ctx.DisableOverrides {
 			h = handlers.FailureSimulationHandler(ctx, h)
 		}
+
+		// The upgrades are subject to the rate limit, the overrides and the validation
+		h = handlers.WebSocketProxyHandler(ctx, h)
+
+		if ctx.Validation.Enabled() {
+			h = handlers.ValidationHandler(ctx, h)
+		}
+
+		if !ctx.DisableOverrides {
+			h = handlers.OverrideHandler(ctx, h)
+		}
+
+		if ctx.RateLimit.Enabled() {
+			h = handlers.RateLimitHandler(ctx, h)
+		}
 	}
 
 	return h
@@ -16,6 +16,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/netbucket/httpr/context"
 	"github.com/spf13/cobra"
@@ -48,6 +49,23 @@ func init() {
 
 	RootCmd.PersistentFlags().StringVarP(&ctx.HttpService, "http", "s", ":8081", "HTTP/HTTPS service address")
 	RootCmd.PersistentFlags().BoolVarP(&ctx.EnableTLS, "enable-tls", "t", false, "Start in TLS/HTTPS mode")
+	RootCmd.PersistentFlags().BoolVarP(&ctx.EnableHTTP3, "http3", "", false, "Also accept HTTP/3 (QUIC) connections on the same UDP port (for use with -t)")
+	RootCmd.PersistentFlags().BoolVarP(&ctx.EnableH2C, "h2c", "", false, "Accept cleartext HTTP/2 (h2c) connections when not in TLS/HTTPS mode")
 	RootCmd.PersistentFlags().StringVarP(&ctx.CertFile, "tls-cert-file", "", "", "Public certificate file name (for use with -t). If blank, a temporary self-signed cert is used.")
 	RootCmd.PersistentFlags().StringVarP(&ctx.KeyFile, "tls-key-file", "", "", "Private key file name  (for use with -t). If blank, a temporary self-signed cert is used.")
+	RootCmd.PersistentFlags().StringVarP(&ctx.CADir, "tls-ca-dir", "", "", "Directory of the local CA issuing the server certificates (for use with -t). The CA is created if missing.")
+	RootCmd.PersistentFlags().StringVarP(&ctx.CABundleFile, "tls-ca-bundle", "", "", "Write the local CA certificate bundle to the specified file (for use with --tls-ca-dir, or with --tls-fault for the generated fault simulation CA)")
+	RootCmd.PersistentFlags().StringSliceVarP(&ctx.TLSHosts, "tls-hosts", "", nil, "Host names of the certificate issued by the local CA. If blank, certificates are issued per SNI server name.")
+	RootCmd.PersistentFlags().StringVarP(&ctx.TLSFault, "tls-fault", "", "", "Serve a broken certificate (for use with -t): "+strings.Join(context.TLSFaults, ", "))
+	RootCmd.PersistentFlags().StringToStringVarP(&ctx.TLSFaultSNI, "tls-fault-sni", "", nil, "Serve a broken certificate for the SNI server names (for use with -t), e.g. bad.example.com=expired")
+	RootCmd.PersistentFlags().StringVarP(&ctx.ClientCAFile, "tls-client-ca", "", "", "CA certificate file name used to verify client certificates (for use with -t)")
+	RootCmd.PersistentFlags().StringVarP(&ctx.ClientAuth, "tls-client-auth", "", "none", "Client certificate mode (for use with -t): none, request, require or verify")
+	RootCmd.PersistentFlags().StringVarP(&ctx.TLSPolicy.MinVersion, "tls-min-version", "", "", "Minimum TLS version (for use with -t): 1.0, 1.1, 1.2 or 1.3")
+	RootCmd.PersistentFlags().StringVarP(&ctx.TLSPolicy.MaxVersion, "tls-max-version", "", "", "Maximum TLS version (for use with -t): 1.0, 1.1, 1.2 or 1.3")
+	RootCmd.PersistentFlags().StringSliceVarP(&ctx.TLSPolicy.CipherSuites, "tls-ciphers", "", nil, "TLS 1.0-1.2 cipher suites (for use with -t), e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	RootCmd.PersistentFlags().StringSliceVarP(&ctx.TLSPolicy.Curves, "tls-curves", "", nil, "TLS key exchange curves (for use with -t): X25519, P256, P384 or P521")
+	RootCmd.PersistentFlags().StringSliceVarP(&ctx.TLSPolicy.ALPN, "tls-alpn", "", nil, "ALPN protocols offered to the clients (for use with -t). Defaults to h2,http/1.1")
+	RootCmd.PersistentFlags().IntVarP(&ctx.TLSPolicy.HandshakeDelay, "tls-handshake-delay", "", 0, "Delay, in milliseconds, before replying to the TLS ClientHello (for use with -t)")
+	RootCmd.PersistentFlags().BoolVarP(&ctx.TLSPolicy.HandshakeAbort, "tls-handshake-abort", "", false, "Abort every TLS handshake by closing the connection (for use with -t)")
+	RootCmd.PersistentFlags().IntVarP(&ctx.TLSPolicy.HandshakeAlert, "tls-handshake-alert", "", 0, "Fail every TLS handshake with the specified alert code, e.g. 40 for handshake_failure (for use with -t)")
 }
@@ -0,0 +1,106 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/handlers"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve <dir>",
+	Short: "Serve static files from a directory",
+	Long: `Start the HTTP server that will serve the files in the directory indicated by the dir argument,
+and log the incoming HTTP requests to the standard output. See options to modify the HTTP response behavior.`,
+	Run: executeServe,
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	ctx := context.Instance()
+
+	serveCmd.Flags().BoolVarP(&ctx.LogJSON, "json", "j", false, "Log HTTP requests in JSON format")
+	serveCmd.Flags().BoolVarP(&ctx.LogPrettyJSON, "json-pp", "p", false, "Log HTTP requests in pretty-printed (indented) JSON format")
+	serveCmd.Flags().BoolVarP(&ctx.ListDirs, "list-dirs", "l", false, "List the contents of directories that do not contain an index.html file")
+	serveCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, when replying to incoming HTTP requests")
+	serveCmd.Flags().BoolVarP(&ctx.DisableOverrides, "disable-overrides", "", false, "Ignore the X-Httpr-Delay and X-Httpr-Fail request headers overriding the behavior for a single request")
+	serveCmd.Flags().BoolVarP(&ctx.FailureMode.Enabled, "simulate-failure", "f", false, "Simulate a transient failure: return an error code before serving the file")
+	serveCmd.Flags().IntVarP(&ctx.FailureMode.FailureCount, "simulate-failure-count", "", 1, "For --simulate-failure, determines how many errors are returned before serving the file")
+	serveCmd.Flags().IntVarP(&ctx.FailureMode.SuccessCount, "simulate-success-count", "", 1, "For --simulate-failure, determines how many files are served before returning a error code")
+	serveCmd.Flags().IntVarP(&ctx.FailureMode.FailureCode, "simulate-failure-code", "", 500, "For --simulate-failure, determines the HTTP status code for an error response")
+	serveCmd.Flags().VarP(&ctx.FailureMode.Sequence, "simulate-sequence", "", "Script the exact responses, e.g. 503,503,timeout,200x5,429(retry-after=2),reset. The sequence loops, unless the last step repeats forever, e.g. 503x2,200x*")
+	serveCmd.Flags().StringVarP(&ctx.FailureMode.Key, "simulate-failure-key", "", "global", "For --simulate-failure and --simulate-sequence, track the failures independently per key: global, ip, path, api-key, idempotency-key or header:<name>")
+	serveCmd.Flags().IntVarP(&ctx.FailureMode.KeyExpiry, "simulate-failure-key-expiry", "", 300, "For --simulate-failure-key, restart the failures of keys idle for the specified number of seconds (0 disables)")
+}
+
+func executeServe(cmd *cobra.Command, args []string) {
+
+	if len(args) == 0 {
+		log.Fatal("Directory argument missing")
+	}
+
+	if stat, err := os.Stat(args[0]); err != nil {
+		log.Fatal(err)
+	} else if !stat.IsDir() {
+		log.Fatalf("%s is not a directory", args[0])
+	}
+
+	ctx := context.Instance()
+
+	ctx.ServeDir = args[0]
+
+	if err := context.ValidateRequestKey(ctx.FailureMode.Key); err != nil {
+		log.Fatal(err)
+	}
+
+	h := setupServeHandlerChain(ctx)
+
+	http.Handle("/", h)
+
+	// Start the HTTP server and handle the command
+	ctx.StartServer()
+
+	ctx.Close()
+}
+
+func setupServeHandlerChain(ctx *context.Context) http.Handler {
+	var h http.Handler
+	{
+		h = handlers.FileServerHandler(ctx, nil)
+
+		h = handlers.DelayHandler(ctx, h)
+
+		if ctx.LogJSON || ctx.LogPrettyJSON {
+			h = handlers.JSONRequestLoggingHandler(ctx, h)
+		} else {
+			h = handlers.RawRequestLoggingHandler(ctx, h)
+		}
+
+		if ctx.FailureSimulationEnabled() || !ctx.DisableOverrides {
+			h = handlers.FailureSimulationHandler(ctx, h)
+		}
+
+		if !ctx.DisableOverrides {
+			h = handlers.OverrideHandler(ctx, h)
+		}
+	}
+
+	return h
+}
@@ -0,0 +1,63 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/handlers"
+	"github.com/spf13/cobra"
+)
+
+var tcpProxyCmd = &cobra.Command{
+	Use:   "tcp-proxy <upstream-address>",
+	Short: "Proxy raw TCP connections to an upstream server.",
+	Long: `Start the TCP server that will relay connections to an upstream server indicated by the upstream-address
+argument (host:port), and log the byte counts of every connection to the standard output.
+See options to inject latency, bandwidth limits, connection resets and half-open connections.`,
+	Run: executeTCPProxy,
+}
+
+func init() {
+	RootCmd.AddCommand(tcpProxyCmd)
+
+	ctx := context.Instance()
+
+	tcpProxyCmd.Flags().IntVarP(&ctx.Delay, "delay", "d", 0, "Delay, in milliseconds, before relaying each chunk of data")
+	tcpProxyCmd.Flags().IntVarP(&ctx.TCPProxy.Bandwidth, "bandwidth", "", 0, "Limit the throughput of each direction of a connection, in bytes per second (0 disables)")
+	tcpProxyCmd.Flags().Float64VarP(&ctx.TCPProxy.ResetProbability, "reset-probability", "", 0, "Probability, between 0 and 1, of resetting the connection before relaying each chunk of data")
+	tcpProxyCmd.Flags().Float64VarP(&ctx.TCPProxy.HalfOpenProbability, "half-open-probability", "", 0, "Probability, between 0 and 1, of accepting a connection without ever relaying nor closing it")
+}
+
+func executeTCPProxy(cmd *cobra.Command, args []string) {
+
+	if len(args) == 0 {
+		log.Fatal("Upstream address argument missing")
+	}
+
+	ctx := context.Instance()
+
+	if ctx.TCPProxy.ResetProbability < 0 || ctx.TCPProxy.ResetProbability > 1 ||
+		ctx.TCPProxy.HalfOpenProbability < 0 || ctx.TCPProxy.HalfOpenProbability > 1 {
+		log.Fatal("Probabilities must be between 0 and 1")
+	}
+
+	ctx.TCPProxy.Upstream = args[0]
+
+	// Start the TCP server and handle the command
+	ctx.StartTCPServer(handlers.TCPProxyHandler(ctx))
+
+	ctx.Close()
+}
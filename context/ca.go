@@ -0,0 +1,272 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File names of the local certificate authority in the CA directory
+const (
+	caCertFileName = "ca.pem"
+	caKeyFileName  = "ca-key.pem"
+)
+
+// leafValidity is the validity period of the certificates issued by the local CA
+const leafValidity = 24 * time.Hour * 365
+
+// maxCachedCertificates is the number of issued certificates kept in a cache
+const maxCachedCertificates = 1000
+
+// certCache holds the issued certificates by key, evicting the oldest ones
+// beyond maxCachedCertificates. It is not safe for concurrent use
+type certCache struct {
+	certs map[string]*tls.Certificate
+	keys  []string
+}
+
+// leafCertificates issues, and caches, the certificates for the SNI server names
+type leafCertificates struct {
+	mutex sync.Mutex
+	ca    *certAuthority
+	certs certCache
+}
+
+// configureLocalCA sets up the TLS configuration to serve certificates issued by the
+// local certificate authority: for the configured host names, or on demand per SNI server name
+func (ctx *Context) configureLocalCA(config *tls.Config) error {
+	ca, err := ctx.loadLocalCA()
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Using the local CA certificate in %s", filepath.Join(ctx.CADir, caCertFileName))
+
+	if len(ctx.CABundleFile) > 0 {
+		if err := ioutil.WriteFile(ctx.CABundleFile, ca.certPEM(), 0644); err != nil {
+			return err
+		}
+	}
+
+	hosts := ctx.TLSHosts
+
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+
+	cert, err := ca.issue(hosts, time.Now().Add(-time.Hour), time.Now().Add(leafValidity), 0)
+
+	if err != nil {
+		return err
+	}
+
+	config.Certificates = []tls.Certificate{*cert}
+
+	// Without configured host names, issue a certificate for every SNI server name
+	if len(ctx.TLSHosts) == 0 {
+		leaves := &leafCertificates{ca: ca}
+		config.GetCertificate = leaves.certificate
+	}
+
+	return nil
+}
+
+// certificate returns the certificate issued by the local CA for the SNI server name
+func (lc *leafCertificates) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.ServerName) == 0 {
+		return nil, nil
+	}
+
+	return lc.issue(hello.ServerName)
+}
+
+// issue returns the certificate issued by the local CA for the host, issuing it if needed
+func (lc *leafCertificates) issue(host string) (*tls.Certificate, error) {
+	lc.mutex.Lock()
+
+	defer lc.mutex.Unlock()
+
+	if cert, ok := lc.certs.get(host); ok {
+		return cert, nil
+	}
+
+	cert, err := lc.ca.issue([]string{host}, time.Now().Add(-time.Hour), time.Now().Add(leafValidity), 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lc.certs.add(host, cert)
+
+	return cert, nil
+}
+
+// get returns the cached certificate for the key
+func (cc *certCache) get(key string) (*tls.Certificate, bool) {
+	cert, ok := cc.certs[key]
+	return cert, ok
+}
+
+// add caches the certificate for the key, evicting the oldest certificate if the cache is full
+func (cc *certCache) add(key string, cert *tls.Certificate) {
+	if cc.certs == nil {
+		cc.certs = make(map[string]*tls.Certificate)
+	}
+
+	if _, ok := cc.certs[key]; !ok {
+		if len(cc.keys) >= maxCachedCertificates {
+			delete(cc.certs, cc.keys[0])
+			cc.keys = cc.keys[1:]
+		}
+
+		cc.keys = append(cc.keys, key)
+	}
+
+	cc.certs[key] = cert
+}
+
+// InterceptionCertificate returns a certificate for the host issued by the local CA,
+// used to terminate TLS when intercepting the traffic to the host
+func (ctx *Context) InterceptionCertificate(host string) (*tls.Certificate, error) {
+	ca, err := ctx.loadLocalCA()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Mutex.Lock()
+
+	if ctx.interceptionCerts == nil {
+		ctx.interceptionCerts = &leafCertificates{ca: ca}
+	}
+
+	ctx.Mutex.Unlock()
+
+	return ctx.interceptionCerts.issue(host)
+}
+
+// loadLocalCA returns the local certificate authority in the CA directory, loading
+// or creating it on first use
+func (ctx *Context) loadLocalCA() (*certAuthority, error) {
+	ctx.Mutex.Lock()
+
+	defer ctx.Mutex.Unlock()
+
+	if ctx.localCA == nil {
+		ca, err := loadOrCreateCA(ctx.CADir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.localCA = ca
+	}
+
+	return ctx.localCA, nil
+}
+
+// loadOrCreateCA loads the local certificate authority from the directory,
+// creating and persisting a new one if the directory does not contain it yet
+func loadOrCreateCA(dir string) (*certAuthority, error) {
+	certFile := filepath.Join(dir, caCertFileName)
+	keyFile := filepath.Join(dir, caKeyFileName)
+
+	if _, err := os.Stat(certFile); err == nil {
+		return loadCA(certFile, keyFile)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ca, err := newCertAuthority("httpr local CA", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(certFile, ca.certPEM(), 0644); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+// loadCA reads the PEM-encoded CA certificate and private key files
+func loadCA(certFile, keyFile string) (*certAuthority, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("invalid CA certificate or key in %s", filepath.Dir(certFile))
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type in %s", keyFile)
+	}
+
+	return &certAuthority{cert: cert, key: signer}, nil
+}
+
+// certPEM returns the PEM-encoded certificate of the certificate authority
+func (ca *certAuthority) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
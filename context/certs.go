@@ -0,0 +1,397 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLS certificate faults that can be simulated by the HTTPS listener
+const (
+	FaultExpired         = "expired"
+	FaultNotYetValid     = "not-yet-valid"
+	FaultWrongHost       = "wrong-host"
+	FaultSelfSigned      = "self-signed"
+	FaultUntrustedCA     = "untrusted-ca"
+	FaultWeakKey         = "weak-key"
+	FaultIncompleteChain = "incomplete-chain"
+)
+
+// TLSFaults lists the supported TLS certificate faults
+var TLSFaults = []string{
+	FaultExpired, FaultNotYetValid, FaultWrongHost, FaultSelfSigned,
+	FaultUntrustedCA, FaultWeakKey, FaultIncompleteChain,
+}
+
+// wrongHostName is the only host name in the certificates for the wrong-host fault
+const wrongHostName = "wrong-host.httpr.invalid"
+
+// weakKeyBits is the RSA key size used for the weak-key fault
+const weakKeyBits = 1024
+
+// certAuthority is a certificate authority able to issue leaf and intermediate certificates
+type certAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// faultCertificates generates, and caches, the certificates for the TLS faults.
+// Except for the untrusted-ca and self-signed faults, the certificates are signed by
+// the trusted CA, so that each of them fails verification for a single reason
+type faultCertificates struct {
+	mutex        sync.Mutex
+	ca           *certAuthority
+	intermediate *certAuthority
+	untrusted    *certAuthority
+	certs        certCache
+}
+
+// newFaultCertificates creates the fault certificates signed by the trusted CA,
+// or by a generated root CA if it is nil
+func newFaultCertificates(ca *certAuthority) (*faultCertificates, error) {
+	if ca == nil {
+		root, err := newCertAuthority("httpr fault simulation root CA", nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ca = root
+	}
+
+	intermediate, err := newCertAuthority("httpr fault simulation intermediate CA", ca)
+
+	if err != nil {
+		return nil, err
+	}
+
+	untrusted, err := newCertAuthority("httpr untrusted CA", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultCertificates{
+		ca: ca, intermediate: intermediate, untrusted: untrusted,
+	}, nil
+}
+
+// configureTLSFaults sets up the TLS configuration to serve broken certificates,
+// either for every connection or for the SNI server names they are configured for
+func (ctx *Context) configureTLSFaults(config *tls.Config) error {
+	for _, fault := range append([]string{ctx.TLSFault}, sniFaults(ctx.TLSFaultSNI)...) {
+		if len(fault) > 0 && !isTLSFault(fault) {
+			return fmt.Errorf("unsupported TLS fault: %s", fault)
+		}
+	}
+
+	// Sign the faults with the local CA the clients trust, if there is one
+	var ca *certAuthority
+
+	if len(ctx.CADir) > 0 {
+		localCA, err := ctx.loadLocalCA()
+
+		if err != nil {
+			return err
+		}
+
+		ca = localCA
+	}
+
+	faults, err := newFaultCertificates(ca)
+
+	if err != nil {
+		return err
+	}
+
+	// Without a local CA, let the clients trust the generated one, so that each fault fails for its own reason only
+	if ca == nil {
+		if err := ctx.writeFaultCA(faults.ca); err != nil {
+			return err
+		}
+	}
+
+	getCertificate := config.GetCertificate
+
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		fault, ok := ctx.TLSFaultSNI[hello.ServerName]
+
+		if !ok {
+			fault = ctx.TLSFault
+		}
+
+		if len(fault) == 0 {
+			// Fall back to the regular server certificate
+			if getCertificate != nil {
+				return getCertificate(hello)
+			}
+			return nil, nil
+		}
+
+		return faults.certificate(fault, hello.ServerName)
+	}
+
+	// Without SNI, the certificate is only requested from GetCertificate if there is no default certificate
+	if len(ctx.TLSFault) > 0 {
+		config.Certificates = nil
+	}
+
+	return nil
+}
+
+// writeFaultCA writes the certificate of the generated fault simulation CA to the CA bundle
+// file, or to a temporary file if there is none, and logs its location
+func (ctx *Context) writeFaultCA(ca *certAuthority) error {
+	fileName := ctx.CABundleFile
+
+	if len(fileName) == 0 {
+		f, err := ioutil.TempFile("", "httpr-fault-ca-*.pem")
+
+		if err != nil {
+			return err
+		}
+
+		f.Close()
+
+		fileName = f.Name()
+	}
+
+	if err := ioutil.WriteFile(fileName, ca.certPEM(), 0644); err != nil {
+		return err
+	}
+
+	log.Printf("Using the fault simulation CA certificate in %s", fileName)
+
+	return nil
+}
+
+// sniFaults returns the faults configured for the SNI server names
+func sniFaults(faults map[string]string) []string {
+	var values []string
+
+	for _, fault := range faults {
+		values = append(values, fault)
+	}
+
+	return values
+}
+
+// isTLSFault determines if the fault name is supported
+func isTLSFault(fault string) bool {
+	for _, f := range TLSFaults {
+		if f == fault {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns the certificate simulating the fault for the server name
+func (fc *faultCertificates) certificate(fault, serverName string) (*tls.Certificate, error) {
+	fc.mutex.Lock()
+
+	defer fc.mutex.Unlock()
+
+	cacheKey := fault + "|" + serverName
+
+	if cert, ok := fc.certs.get(cacheKey); ok {
+		return cert, nil
+	}
+
+	hosts := []string{"localhost", "127.0.0.1"}
+
+	if len(serverName) > 0 {
+		hosts = []string{serverName}
+	}
+
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour*365)
+
+	var cert *tls.Certificate
+	var err error
+
+	switch fault {
+	case FaultExpired:
+		cert, err = fc.ca.issue(hosts, notBefore.Add(-2*24*time.Hour*365), notBefore.Add(-24*time.Hour), 0)
+	case FaultNotYetValid:
+		cert, err = fc.ca.issue(hosts, notAfter, notAfter.Add(24*time.Hour*365), 0)
+	case FaultWrongHost:
+		cert, err = fc.ca.issue([]string{wrongHostName}, notBefore, notAfter, 0)
+	case FaultSelfSigned:
+		cert, err = newSelfSignedCertificate(hosts, notBefore, notAfter)
+	case FaultUntrustedCA:
+		cert, err = fc.untrusted.issue(hosts, notBefore, notAfter, 0)
+	case FaultWeakKey:
+		cert, err = fc.ca.issue(hosts, notBefore, notAfter, weakKeyBits)
+	case FaultIncompleteChain:
+		// The intermediate CA certificate is left out of the chain presented to the client
+		cert, err = fc.intermediate.issue(hosts, notBefore, notAfter, 0)
+	default:
+		err = fmt.Errorf("unsupported TLS fault: %s", fault)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fc.certs.add(cacheKey, cert)
+
+	return cert, nil
+}
+
+// newCertAuthority creates a certificate authority, self-signed if the parent is nil
+func newCertAuthority(commonName string, parent *certAuthority) (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newCertTemplate(commonName, time.Now().Add(-time.Hour), time.Now().Add(10*24*time.Hour*365))
+
+	if err != nil {
+		return nil, err
+	}
+
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	issuerCert, issuerKey := template, crypto.Signer(key)
+
+	if parent != nil {
+		issuerCert, issuerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuerCert, key.Public(), issuerKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// issue creates a leaf certificate for the hosts signed by the certificate authority.
+// An RSA key of the specified size is used if rsaBits is set, ECDSA P-256 otherwise
+func (ca *certAuthority) issue(hosts []string, notBefore, notAfter time.Time, rsaBits int) (*tls.Certificate, error) {
+	key, err := newPrivateKey(rsaBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newLeafTemplate(hosts, notBefore, notAfter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newSelfSignedCertificate creates a self-signed leaf certificate for the hosts
+func newSelfSignedCertificate(hosts []string, notBefore, notAfter time.Time) (*tls.Certificate, error) {
+	key, err := newPrivateKey(0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newLeafTemplate(hosts, notBefore, notAfter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newPrivateKey generates an RSA key of the specified size, or an ECDSA P-256 key if rsaBits is 0
+func newPrivateKey(rsaBits int) (crypto.Signer, error) {
+	if rsaBits > 0 {
+		return rsa.GenerateKey(rand.Reader, rsaBits)
+	}
+
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// newLeafTemplate creates a server certificate template for the hosts
+func newLeafTemplate(hosts []string, notBefore, notAfter time.Time) (*x509.Certificate, error) {
+	template, err := newCertTemplate(hosts[0], notBefore, notAfter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return template, nil
+}
+
+// newCertTemplate creates a certificate template with a random serial number
+func newCertTemplate(commonName string, notBefore, notAfter time.Time) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"httpr"}, CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+	}, nil
+}
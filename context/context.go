@@ -25,25 +25,65 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/netbucket/privatetls"
+	"github.com/netbucket/httpr/openapi"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Context type holds the desired execution profile for a command
 type Context struct {
-	Mutex           *sync.Mutex
-	HttpService     string
-	EnableTLS       bool
-	CertFile        string
-	KeyFile         string
-	UpstreamURL     *url.URL
-	Out             io.Writer
-	LogJSON         bool
-	LogPrettyJSON   bool
-	Echo            bool
-	HttpCode        int
-	Delay           int
-	IgnoreTLSErrors bool
-	FailureMode     FailureSimulation
+	Mutex                *sync.Mutex
+	HttpService          string
+	EnableTLS            bool
+	EnableH2C            bool
+	EnableHTTP3          bool
+	CertFile             string
+	KeyFile              string
+	CADir                string
+	CABundleFile         string
+	TLSHosts             []string
+	localCA              *certAuthority
+	interceptionCerts    *leafCertificates
+	TLSFault             string
+	TLSFaultSNI          map[string]string
+	TLSPolicy            TLSPolicy
+	ClientCAFile         string
+	ClientAuth           string
+	UpstreamURL          *url.URL
+	ServeDir             string
+	ListDirs             bool
+	BinPrefix            string
+	OpenAPIFile          string
+	OpenAPI              *openapi.Document
+	ScenariosFile        string
+	Scenarios            []*Scenario
+	Validation           ValidationOptions
+	Infer                InferOptions
+	Out                  io.Writer
+	Handler              http.Handler
+	LogJSON              bool
+	LogPrettyJSON        bool
+	LogResponses         bool
+	Echo                 bool
+	ResponseBody         string
+	ResponseTemplateFile string
+	HttpCode             int
+	GRPCStatus           int
+	Delay                int
+	DisableOverrides     bool
+	IgnoreTLSErrors      bool
+	Upstream             UpstreamOptions
+	ForwardProxy         ForwardProxyOptions
+	TCPProxy             TCPProxyOptions
+	FailureMode          FailureSimulation
+	keyedFailureModes    map[string]*FailureSimulation
+	lastFailureModeSweep time.Time
+	RateLimit            RateLimitOptions
+	rateLimiters         map[string]*rateLimiter
+	lastRateLimitSweep   time.Time
+	WebSocket            WebSocketSimulation
+	Stream               StreamSimulation
 }
 
 // FailureSimulation desribes the intended behavior of the transient failure mode in httpr
@@ -52,11 +92,58 @@ type FailureSimulation struct {
 	FailureCount          int
 	SuccessCount          int
 	FailureCode           int
+	GRPCStatus            int
+	Sequence              FailureSequence
+	Key                   string
+	KeyExpiry             int
+	lastUsed              time.Time
+	sequenceStep          int
+	sequenceIteration     int
 	failureIterationCount int
 	successIterationCount int
 	failureSimulated      bool
 }
 
+// WebSocketSimulation describes the intended behavior of httpr for WebSocket connections
+type WebSocketSimulation struct {
+	FrameDelay   int
+	CloseAfter   int
+	CloseCode    int
+	MaxFrameSize int
+}
+
+// StreamSimulation describes the intended behavior of httpr when streaming responses
+type StreamSimulation struct {
+	Mode            string
+	Count           int
+	Interval        int
+	Data            string
+	EventName       string
+	DisconnectAfter int
+}
+
+// ForwardProxyOptions describes the per destination host behavior of the forward proxy
+type ForwardProxyOptions struct {
+	HostDelays map[string]int
+	FailHosts  []string
+	Intercept  bool
+}
+
+// FailsHost determines if the failure simulation applies to the destination host.
+// If no hosts are specified, it applies to every host
+func (fp *ForwardProxyOptions) FailsHost(host string) bool {
+	if len(fp.FailHosts) == 0 {
+		return true
+	}
+
+	for _, h := range fp.FailHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
 var singleton *Context
 
 var once sync.Once
@@ -70,14 +157,35 @@ func Instance() *Context {
 
 // Start the HTTP server
 func (ctx *Context) StartServer() {
+	var h http.Handler = http.DefaultServeMux
+
+	// Serve every request, including CONNECT requests rejected by the ServeMux, with the handler
+	if ctx.Handler != nil {
+		h = ctx.Handler
+	}
 
 	if ctx.EnableTLS {
-		go log.Fatal(startHTTPSListener(ctx.HttpService, ctx.CertFile, ctx.KeyFile))
+		tlsConfig, err := ctx.newServerTLSConfig()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if ctx.EnableHTTP3 {
+			h = startHTTP3Listener(ctx.HttpService, ctx.newQUICTLSConfig(tlsConfig), h)
+		}
+
+		go log.Fatal(startHTTPSListener(ctx.HttpService, tlsConfig, h))
 	} else {
-		go log.Fatal(http.ListenAndServe(ctx.HttpService, nil))
+		// Accept cleartext HTTP/2 with prior knowledge or via the HTTP/1.1 Upgrade
+		if ctx.EnableH2C {
+			h = h2c.NewHandler(h, &http2.Server{})
+		}
+
+		go log.Fatal(http.ListenAndServe(ctx.HttpService, h))
 	}
 
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 }
@@ -88,36 +196,127 @@ func (ctx *Context) SimulateFailure() int {
 
 	defer ctx.Mutex.Unlock()
 
-	var outcome int = ctx.HttpCode
+	return ctx.FailureMode.simulate(ctx.HttpCode)
+}
+
+// SimulateFailureFor will run a failure simulation tracked independently for the key,
+// and return an HTTP code representing the outcome, and whether it is a failure
+func (ctx *Context) SimulateFailureFor(key string) (int, bool) {
+	ctx.Mutex.Lock()
+
+	defer ctx.Mutex.Unlock()
+
+	fm := ctx.keyedFailureMode(key, time.Now())
+
+	outcome := fm.simulate(ctx.HttpCode)
+
+	return outcome, (fm.Enabled || len(fm.Sequence) > 0) && fm.failureSimulated
+}
+
+// SimulateFailureStepFor will advance the scripted failure sequence tracked independently
+// for the key, and return the current step
+func (ctx *Context) SimulateFailureStepFor(key string) FailureStep {
+	ctx.Mutex.Lock()
+
+	defer ctx.Mutex.Unlock()
+
+	return ctx.keyedFailureMode(key, time.Now()).nextStep()
+}
+
+// FailureKeyed returns true if the failure simulation is tracked independently per request key
+func (ctx *Context) FailureKeyed() bool {
+	return len(ctx.FailureMode.Key) > 0 && ctx.FailureMode.Key != RequestKeyGlobal
+}
+
+// keyedFailureMode returns the failure simulation tracked for the key, starting a new one
+// for new keys and keys idle for longer than the key expiry. Must be called with the mutex locked
+func (ctx *Context) keyedFailureMode(key string, now time.Time) *FailureSimulation {
+	if ctx.keyedFailureModes == nil {
+		ctx.keyedFailureModes = make(map[string]*FailureSimulation)
+	}
+
+	expiry := time.Duration(ctx.FailureMode.KeyExpiry) * time.Second
+
+	// Forget the idle keys, at most once per expiry period
+	if expiry > 0 && now.Sub(ctx.lastFailureModeSweep) >= expiry {
+		for k, fm := range ctx.keyedFailureModes {
+			if now.Sub(fm.lastUsed) >= expiry {
+				delete(ctx.keyedFailureModes, k)
+			}
+		}
+
+		ctx.lastFailureModeSweep = now
+	}
+
+	fm, ok := ctx.keyedFailureModes[key]
+
+	if !ok || (expiry > 0 && now.Sub(fm.lastUsed) >= expiry) {
+		fm = &FailureSimulation{
+			Enabled:      ctx.FailureMode.Enabled,
+			FailureCount: ctx.FailureMode.FailureCount,
+			SuccessCount: ctx.FailureMode.SuccessCount,
+			FailureCode:  ctx.FailureMode.FailureCode,
+			GRPCStatus:   ctx.FailureMode.GRPCStatus,
+			Sequence:     ctx.FailureMode.Sequence,
+		}
+		ctx.keyedFailureModes[key] = fm
+	}
+
+	fm.lastUsed = now
+
+	return fm
+}
+
+// SimulateFailureStep will advance the scripted failure sequence, and return the current step
+func (ctx *Context) SimulateFailureStep() FailureStep {
+	ctx.Mutex.Lock()
+
+	defer ctx.Mutex.Unlock()
+
+	return ctx.FailureMode.nextStep()
+}
+
+// simulate advances the failure simulation sequence, and returns the failure code
+// or the success code representing the outcome
+func (fm *FailureSimulation) simulate(successCode int) int {
+	var outcome int = successCode
+
+	if len(fm.Sequence) > 0 {
+		// Timeouts and resets can't be represented by a status code: report the failure code instead
+		if step := fm.nextStep(); step.Action == FailureActionStatus {
+			return step.StatusCode
+		}
+		return fm.FailureCode
+	}
 
-	if ctx.FailureMode.Enabled {
-		if ctx.FailureMode.failureIterationCount < ctx.FailureMode.FailureCount {
-			outcome = ctx.FailureMode.FailureCode
-			ctx.FailureMode.failureSimulated = true
+	if fm.Enabled {
+		if fm.failureIterationCount < fm.FailureCount {
+			outcome = fm.FailureCode
+			fm.failureSimulated = true
 
-			ctx.FailureMode.failureIterationCount++
+			fm.failureIterationCount++
 
-			if ctx.FailureMode.failureIterationCount == ctx.FailureMode.FailureCount {
+			if fm.failureIterationCount == fm.FailureCount {
 				// Done with the failure sequence, next call will return success if needed
 				// Otherwise, continue with the failure sequence if success count is set to 0
-				if ctx.FailureMode.SuccessCount > 0 {
-					ctx.FailureMode.successIterationCount = 0
+				if fm.SuccessCount > 0 {
+					fm.successIterationCount = 0
 				} else {
-					ctx.FailureMode.failureIterationCount = 0
+					fm.failureIterationCount = 0
 				}
 			}
 
-		} else if ctx.FailureMode.successIterationCount < ctx.FailureMode.SuccessCount {
-			ctx.FailureMode.successIterationCount++
-			ctx.FailureMode.failureSimulated = false
+		} else if fm.successIterationCount < fm.SuccessCount {
+			fm.successIterationCount++
+			fm.failureSimulated = false
 
-			if ctx.FailureMode.successIterationCount == ctx.FailureMode.SuccessCount {
+			if fm.successIterationCount == fm.SuccessCount {
 				// Done with the success sequence, next call will return failure if needed
 				// Otherwise, continue with the success sequence if failure count is set to 0
-				if ctx.FailureMode.FailureCount > 0 {
-					ctx.FailureMode.failureIterationCount = 0
+				if fm.FailureCount > 0 {
+					fm.failureIterationCount = 0
 				} else {
-					ctx.FailureMode.successIterationCount = 0
+					fm.successIterationCount = 0
 				}
 			}
 		}
@@ -133,14 +332,20 @@ func (ctx *Context) SimulateDelay() {
 	}
 }
 
-//
+// FailureSimulated determines if the last failure simulation produced a failure outcome
 func (ctx *Context) FailureSimulated() bool {
 	return ctx.FailureSimulationEnabled() && ctx.FailureMode.failureSimulated
 }
 
+// ResponseDelegated determines if the successful responses are produced by the proxy,
+// the file server or the mock server, rather than the configured response code
+func (ctx *Context) ResponseDelegated() bool {
+	return ctx.UpstreamURL != nil || len(ctx.ServeDir) > 0 || ctx.OpenAPI != nil || len(ctx.Scenarios) > 0
+}
+
 // Determine if the failure simulation mode is enabled for this invocation
 func (ctx *Context) FailureSimulationEnabled() bool {
-	return ctx.FailureMode.Enabled
+	return ctx.FailureMode.Enabled || len(ctx.FailureMode.Sequence) > 0
 }
 
 // Close the context
@@ -149,24 +354,26 @@ func (ctx *Context) Close() {
 }
 
 // startHTTPSListener starts an HTTPS server at the address specified by the service parameter
-// If either or both certFile and keyFile are blank, a self-singned cert is generated
-func startHTTPSListener(service, certFile, keyFile string) error {
-	s := http.Server{}
+func startHTTPSListener(service string, tlsConfig *tls.Config, h http.Handler) error {
+	s := http.Server{Handler: h, TLSConfig: tlsConfig, ConnContext: trackConnection, ConnState: forgetConnection}
 
-	// If certFile and/or keyFile are blank, generate a self-signed TLS cert
-	if len(certFile) == 0 || len(keyFile) == 0 {
-		selfSignedCert, err := privatetls.NewCert()
+	s.Addr = service
 
-		if err != nil {
-			return err
-		}
+	return s.ListenAndServeTLS("", "")
+}
 
-		s.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{selfSignedCert},
-		}
-	}
+// startHTTP3Listener starts an HTTP/3 (QUIC) server at the UDP address specified by the service
+// parameter, and returns a handler that advertises it to the TCP clients via the Alt-Svc header
+func startHTTP3Listener(service string, tlsConfig *tls.Config, h http.Handler) http.Handler {
+	s := &http3.Server{Addr: service, Handler: h, TLSConfig: tlsConfig}
 
-	s.Addr = service
+	go func() {
+		log.Fatal(s.ListenAndServe())
+	}()
 
-	return s.ListenAndServeTLS(certFile, keyFile)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.SetQUICHeaders(w.Header())
+
+		h.ServeHTTP(w, r)
+	})
 }
@@ -14,8 +14,27 @@
 package context
 
 import (
+	stdcontext "context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestSingleton(t *testing.T) {
@@ -89,3 +108,660 @@ func TestSimulateFailure(t *testing.T) {
 		}
 	}
 }
+
+func TestParseClientAuth(t *testing.T) {
+	tests := map[string]tls.ClientAuthType{
+		"":        tls.NoClientCert,
+		"none":    tls.NoClientCert,
+		"request": tls.RequestClientCert,
+		"require": tls.RequireAnyClientCert,
+		"verify":  tls.RequireAndVerifyClientCert,
+	}
+
+	for mode, expected := range tests {
+		if actual, err := ParseClientAuth(mode); err != nil || actual != expected {
+			t.Errorf("Expected client auth %v for mode %q, got %v (%v)", expected, mode, actual, err)
+		}
+	}
+
+	if _, err := ParseClientAuth("optional"); err == nil {
+		t.Error("Expected an error for an unsupported client auth mode")
+	}
+}
+
+func TestTLSFaultCertificates(t *testing.T) {
+	const host = "api.example.com"
+
+	faults, err := newFaultCertificates(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(faults.ca.cert)
+
+	// The verification error expected when the fault CA is trusted, nil if the certificate verifies
+	tests := map[string]func(err error) bool{
+		FaultExpired: func(err error) bool {
+			e, ok := err.(x509.CertificateInvalidError)
+			return ok && e.Reason == x509.Expired
+		},
+		FaultNotYetValid: func(err error) bool {
+			e, ok := err.(x509.CertificateInvalidError)
+			return ok && e.Reason == x509.Expired
+		},
+		FaultWrongHost: func(err error) bool {
+			e, ok := err.(x509.HostnameError)
+			return ok && e.Host == host
+		},
+		FaultSelfSigned: func(err error) bool {
+			_, ok := err.(x509.UnknownAuthorityError)
+			return ok
+		},
+		FaultUntrustedCA: func(err error) bool {
+			_, ok := err.(x509.UnknownAuthorityError)
+			return ok
+		},
+		FaultIncompleteChain: func(err error) bool {
+			_, ok := err.(x509.UnknownAuthorityError)
+			return ok
+		},
+		FaultWeakKey: func(err error) bool {
+			return err == nil
+		},
+	}
+
+	for fault, expected := range tests {
+		cert, err := faults.certificate(fault, host)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); !expected(err) {
+			t.Errorf("Unexpected verification result for the %s certificate: %v", fault, err)
+		}
+	}
+
+	cert, _ := faults.certificate(FaultIncompleteChain, host)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(faults.intermediate.cert)
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Expected the %s certificate to verify with the intermediate CA, got %v", FaultIncompleteChain, err)
+	}
+
+	cert, _ = faults.certificate(FaultWeakKey, host)
+
+	if key, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok || key.N.BitLen() != weakKeyBits {
+		t.Errorf("Expected a %d bit RSA key for the %s certificate", weakKeyBits, FaultWeakKey)
+	}
+}
+
+func TestLocalCA(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := loadOrCreateCA(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadOrCreateCA(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ca.cert.Equal(reloaded.cert) {
+		t.Error("Expected the local CA to be reloaded from the CA directory")
+	}
+
+	leaves := &leafCertificates{ca: reloaded}
+
+	cert, err := leaves.certificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.certPEM())
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "api.example.com", Roots: roots}); err != nil {
+		t.Errorf("Expected the issued certificate to verify against the CA bundle, got %v", err)
+	}
+}
+
+func TestTLSFaultsSignedByLocalCA(t *testing.T) {
+	ctx := &Context{Mutex: &sync.Mutex{}, CADir: t.TempDir(), TLSFault: FaultExpired}
+
+	config := &tls.Config{}
+
+	if err := ctx.configureTLSFaults(config); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := loadOrCreateCA(ctx.CADir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leaf.CheckSignatureFrom(ca.cert); err != nil {
+		t.Errorf("Expected the fault certificate to be signed by the local CA, got %v", err)
+	}
+}
+
+func TestTLSFaultsCABundle(t *testing.T) {
+	ctx := &Context{Mutex: &sync.Mutex{}, CABundleFile: filepath.Join(t.TempDir(), "ca-bundle.pem"), TLSFault: FaultExpired}
+
+	config := &tls.Config{}
+
+	if err := ctx.configureTLSFaults(config); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := os.ReadFile(ctx.CABundleFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(bundle)
+
+	// Trusting the bundle, the certificate only fails for being expired
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "api.example.com", Roots: roots})
+
+	if e, ok := err.(x509.CertificateInvalidError); !ok || e.Reason != x509.Expired {
+		t.Errorf("Expected the certificate to be expired, got %v", err)
+	}
+}
+
+func TestCertCacheEviction(t *testing.T) {
+	var cache certCache
+
+	for i := 0; i <= maxCachedCertificates; i++ {
+		cache.add(strconv.Itoa(i), &tls.Certificate{})
+	}
+
+	if len(cache.certs) != maxCachedCertificates {
+		t.Errorf("Expected %d cached certificates, got %d", maxCachedCertificates, len(cache.certs))
+	}
+
+	if _, ok := cache.get("0"); ok {
+		t.Error("Expected the oldest certificate to be evicted")
+	}
+
+	if _, ok := cache.get(strconv.Itoa(maxCachedCertificates)); !ok {
+		t.Error("Expected the newest certificate to be cached")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	policy := TLSPolicy{
+		MinVersion:   "1.2",
+		MaxVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"P256"},
+		ALPN:         []string{"http/1.1"},
+	}
+
+	config := &tls.Config{}
+
+	if err := policy.apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 ||
+		len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		len(config.CurvePreferences) != 1 || config.CurvePreferences[0] != tls.CurveP256 ||
+		len(config.NextProtos) != 1 || config.NextProtos[0] != "http/1.1" {
+		t.Errorf("TLS policy not applied as expected: %+v", config)
+	}
+
+	if err := (&TLSPolicy{MinVersion: "2.0"}).apply(&tls.Config{}); err == nil {
+		t.Error("Expected an error for an unsupported TLS version")
+	}
+
+	for _, alert := range []int{-1, 256, 300} {
+		if err := (&TLSPolicy{HandshakeAlert: alert}).apply(&tls.Config{}); err == nil {
+			t.Errorf("Expected an error for the TLS handshake alert %d", alert)
+		}
+	}
+}
+
+func TestTLSHandshakeAlert(t *testing.T) {
+	const expectedAlert = 40
+
+	server, client := net.Pipe()
+
+	defer client.Close()
+
+	policy := TLSPolicy{HandshakeAlert: expectedAlert}
+
+	go policy.simulateHandshakeFault(server)
+
+	record := make([]byte, 7)
+
+	if _, err := io.ReadFull(client, record); err != nil {
+		t.Fatal(err)
+	}
+
+	if record[0] != 21 || record[5] != 2 || record[6] != expectedAlert {
+		t.Errorf("Expected a fatal alert record with code %d, got %v", expectedAlert, record)
+	}
+}
+
+// handshakeFaultTests are the handshake faults simulated over TCP and QUIC, with the delay
+// and the alert expected by the client
+var handshakeFaultTests = []struct {
+	policy        TLSPolicy
+	expectedDelay time.Duration
+	expectedAlert int
+}{
+	{TLSPolicy{HandshakeDelay: 100}, 100 * time.Millisecond, 0},
+	{TLSPolicy{HandshakeAlert: 40}, 0, 40},
+	{TLSPolicy{HandshakeAbort: true}, 0, -1},
+}
+
+func TestTLSHandshakeFaults(t *testing.T) {
+	for _, test := range handshakeFaultTests {
+		ctx := &Context{Mutex: &sync.Mutex{}, TLSPolicy: test.policy}
+
+		config, err := ctx.newServerTLSConfig()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			conn, err := l.Accept()
+
+			if err == nil {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		start := time.Now()
+
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+
+		switch {
+		case test.expectedAlert > 0:
+			if err == nil || !strings.Contains(err.Error(), "remote error: tls: handshake failure") {
+				t.Errorf("Expected the handshake to fail with the alert %d, got %v", test.expectedAlert, err)
+			}
+		case test.expectedAlert < 0:
+			if err == nil || strings.Contains(err.Error(), "remote error") {
+				t.Errorf("Expected the handshake to be aborted without an alert, got %v", err)
+			}
+		default:
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn.Close()
+
+			if d := time.Since(start); d < test.expectedDelay {
+				t.Errorf("Expected the handshake to be delayed by %v, took %v", test.expectedDelay, d)
+			}
+		}
+
+		l.Close()
+	}
+}
+
+func TestQUICHandshakeFaults(t *testing.T) {
+	for _, test := range handshakeFaultTests {
+		ctx := &Context{Mutex: &sync.Mutex{}, TLSPolicy: test.policy}
+
+		config, err := ctx.newServerTLSConfig()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := quic.ListenAddr("127.0.0.1:0", http3.ConfigureTLSConfig(ctx.newQUICTLSConfig(config)), nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			if conn, err := l.Accept(stdcontext.Background()); err == nil {
+				conn.CloseWithError(0, "")
+			}
+		}()
+
+		start := time.Now()
+
+		conn, err := quic.DialAddr(stdcontext.Background(), l.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+
+		var transportErr *quic.TransportError
+
+		switch {
+		case test.expectedAlert != 0:
+			expectedAlert := test.expectedAlert
+
+			// The abort closes the QUIC connection with the internal_error alert
+			if expectedAlert < 0 {
+				expectedAlert = 80
+			}
+
+			if !errors.As(err, &transportErr) || !transportErr.Remote ||
+				transportErr.ErrorCode != quic.TransportErrorCode(0x100+expectedAlert) {
+				t.Errorf("Expected the QUIC handshake to fail with the alert %d, got %v", expectedAlert, err)
+			}
+		default:
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn.CloseWithError(0, "")
+
+			if d := time.Since(start); d < test.expectedDelay {
+				t.Errorf("Expected the QUIC handshake to be delayed by %v, took %v", test.expectedDelay, d)
+			}
+		}
+
+		l.Close()
+	}
+}
+
+func TestUpstreamH2CTransport(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}), &http2.Server{}))
+	defer server.Close()
+
+	ctx := &Context{Upstream: UpstreamOptions{Protocol: UpstreamH2C}}
+
+	transport, err := ctx.NewUpstreamTransport()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if proto, _ := io.ReadAll(resp.Body); string(proto) != "HTTP/2.0" {
+		t.Errorf("Expected the upstream request over HTTP/2.0, got %s", proto)
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type check struct {
+		offset             time.Duration
+		expectedAllowed    bool
+		expectedRemaining  int
+		expectedRetryAfter time.Duration
+	}
+
+	tests := []struct {
+		algorithm string
+		checks    []check
+	}{
+		{RateLimitFixedWindow, []check{
+			{0, true, 1, 0},
+			{10 * time.Second, true, 0, 0},
+			{20 * time.Second, false, 0, 40 * time.Second},
+			{60 * time.Second, true, 1, 0},
+		}},
+		{RateLimitSlidingWindow, []check{
+			{0, true, 1, 0},
+			{10 * time.Second, true, 0, 0},
+			{20 * time.Second, false, 0, 40 * time.Second},
+			{60 * time.Second, true, 0, 0},
+			{65 * time.Second, false, 0, 5 * time.Second},
+		}},
+		{RateLimitTokenBucket, []check{
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{0, false, 0, 30 * time.Second},
+			{30 * time.Second, true, 0, 0},
+		}},
+	}
+
+	for _, test := range tests {
+		ctx := &Context{Mutex: &sync.Mutex{},
+			RateLimit: RateLimitOptions{Algorithm: test.algorithm, Limit: 2, Window: 60, Key: RequestKeyGlobal}}
+
+		for i, c := range test.checks {
+			d := ctx.CheckRateLimit("key", start.Add(c.offset))
+
+			if d.Allowed != c.expectedAllowed || d.Remaining != c.expectedRemaining || d.RetryAfter != c.expectedRetryAfter {
+				t.Errorf("%s check %d: expected allowed=%t remaining=%d retryAfter=%v, got allowed=%t remaining=%d retryAfter=%v",
+					test.algorithm, i, c.expectedAllowed, c.expectedRemaining, c.expectedRetryAfter, d.Allowed, d.Remaining, d.RetryAfter)
+			}
+		}
+	}
+}
+
+func TestRateLimiterExpiry(t *testing.T) {
+	ctx := &Context{Mutex: &sync.Mutex{},
+		RateLimit: RateLimitOptions{Algorithm: RateLimitFixedWindow, Limit: 1, Window: 60, Key: RequestKeyIP}}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 100; i++ {
+		ctx.CheckRateLimit(strconv.Itoa(i), start)
+	}
+
+	if d := ctx.CheckRateLimit("0", start.Add(30*time.Second)); d.Allowed {
+		t.Error("Expected the rate limit of a recently used key to be enforced")
+	}
+
+	ctx.CheckRateLimit("new", start.Add(120*time.Second))
+
+	if len(ctx.rateLimiters) != 1 {
+		t.Errorf("Expected the idle keys to be forgotten, got %d keys", len(ctx.rateLimiters))
+	}
+}
+
+func TestFailureSequence(t *testing.T) {
+	seq, err := ParseFailureSequence("503,timeout,200x2,429(retry-after=2,delay=10),reset")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := seq.String(); s != "503,timeout,200x2,429(retry-after=2,delay=10),reset" {
+		t.Errorf("Unexpected sequence: %s", s)
+	}
+
+	ctx := &Context{Mutex: &sync.Mutex{}, FailureMode: FailureSimulation{Sequence: seq}}
+
+	expected := []string{"503", "timeout", "200", "200", "429(retry-after=2,delay=10)", "reset", "503"}
+
+	for i, e := range expected {
+		step := ctx.SimulateFailureStep()
+		step.Count = 1
+
+		if step.String() != e {
+			t.Errorf("Step %d: expected %s, got %s", i, e, step)
+		}
+
+		if ctx.FailureSimulated() != (e != "200") {
+			t.Errorf("Step %d: unexpected failure simulation outcome %t", i, ctx.FailureSimulated())
+		}
+	}
+
+	// The last step repeating forever is the steady state
+	seq, _ = ParseFailureSequence("503x2,200x*")
+	ctx = &Context{Mutex: &sync.Mutex{}, FailureMode: FailureSimulation{Sequence: seq}}
+
+	for i, e := range []int{503, 503, 200, 200, 200} {
+		if code := ctx.SimulateFailure(); code != e {
+			t.Errorf("Steady state step %d: expected %d, got %d", i, e, code)
+		}
+	}
+
+	for _, invalid := range []string{"", "200x*,503", "abc", "999", "429(foo=1)", "200x0"} {
+		if _, err := ParseFailureSequence(invalid); err == nil {
+			t.Errorf("Expected an error for the sequence %q", invalid)
+		}
+	}
+}
+
+func TestKeyedFailureModeExpiry(t *testing.T) {
+	ctx := &Context{Mutex: &sync.Mutex{},
+		FailureMode: FailureSimulation{Enabled: true, FailureCount: 1, SuccessCount: 1, FailureCode: 503, KeyExpiry: 60},
+		HttpCode:    200}
+
+	start := time.Now()
+
+	tests := []struct {
+		key          string
+		offset       time.Duration
+		expectedCode int
+	}{
+		{"a", 0, 503},
+		{"b", 0, 503},
+		{"a", 30 * time.Second, 200},
+		{"b", 30 * time.Second, 200},
+		// Key a was used 59 seconds ago: it carries on with the sequence
+		{"a", 89 * time.Second, 503},
+		// Key b was idle for 60 seconds: it starts over
+		{"b", 90 * time.Second, 503},
+		{"b", 91 * time.Second, 200},
+	}
+
+	for i, test := range tests {
+		fm := ctx.keyedFailureMode(test.key, start.Add(test.offset))
+
+		if code := fm.simulate(ctx.HttpCode); code != test.expectedCode {
+			t.Errorf("Check %d: expected %d for key %s, got %d", i, test.expectedCode, test.key, code)
+		}
+	}
+
+	ctx.keyedFailureMode("c", start.Add(200*time.Second))
+
+	if len(ctx.keyedFailureModes) != 1 {
+		t.Errorf("Expected the idle keys to be forgotten, got %d keys", len(ctx.keyedFailureModes))
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "scenarios.yaml")
+
+	err := os.WriteFile(fileName, []byte(`
+scenarios:
+  - name: order
+    rules:
+      - {state: Started, request: {method: POST, path: /orders}, response: {status: 201}, nextState: Pending}
+      - {state: Pending, request: {method: GET}, nextState: Complete}
+      - {request: {method: GET}, response: {status: 204}}
+`), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios, err := LoadScenarios(fileName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &Context{Mutex: &sync.Mutex{}, Scenarios: scenarios}
+
+	apply := func(method string) (int, string) {
+		_, rule, state := ctx.ApplyScenarioRule(func(rule *ScenarioRule) bool {
+			return rule.Request.Method == method
+		})
+
+		if rule == nil {
+			return 0, state
+		}
+
+		return rule.Response.Status, state
+	}
+
+	// The rules only match in their state, and transition the scenario to the next state
+	tests := []struct {
+		method         string
+		expectedStatus int
+		expectedState  string
+	}{
+		{"GET", 204, ScenarioStarted},
+		{"POST", 201, ScenarioStarted},
+		{"POST", 0, ""},
+		{"GET", 200, "Pending"},
+		{"GET", 204, "Complete"},
+	}
+
+	for i, test := range tests {
+		if status, state := apply(test.method); status != test.expectedStatus || state != test.expectedState {
+			t.Errorf("Unexpected result of request %d (%s): %d in state %q", i, test.method, status, state)
+		}
+	}
+
+	if err := ctx.SetScenarioState("order", "Pending"); err != nil || ctx.ScenarioStates()[0].State != "Pending" {
+		t.Errorf("Expected the state to be set, got %v %+v", err, ctx.ScenarioStates())
+	}
+
+	if err := ctx.ResetScenarios(""); err != nil || ctx.ScenarioStates()[0].State != ScenarioStarted {
+		t.Errorf("Expected the scenario to be reset, got %v %+v", err, ctx.ScenarioStates())
+	}
+
+	if err := ctx.ResetScenarios("payment"); err == nil {
+		t.Error("Expected an error for an unknown scenario")
+	}
+}
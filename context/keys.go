@@ -0,0 +1,43 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Request keys, determining what rate limits and failure simulations are tracked against.
+// A header request key is the header name prefixed by RequestKeyHeader, e.g. header:X-Test-Id
+const (
+	RequestKeyGlobal      = "global"
+	RequestKeyIP          = "ip"
+	RequestKeyPath        = "path"
+	RequestKeyAPIKey      = "api-key"
+	RequestKeyIdempotency = "idempotency-key"
+	RequestKeyHeader      = "header:"
+)
+
+// ValidateRequestKey checks the request key is supported
+func ValidateRequestKey(key string) error {
+	switch {
+	case key == RequestKeyGlobal, key == RequestKeyIP, key == RequestKeyPath,
+		key == RequestKeyAPIKey, key == RequestKeyIdempotency:
+	case strings.HasPrefix(key, RequestKeyHeader) && len(key) > len(RequestKeyHeader):
+	default:
+		return fmt.Errorf("unsupported request key: %s", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// TLSPolicy describes the TLS protocol constraints and the handshake faults of the HTTPS listener
+type TLSPolicy struct {
+	MinVersion     string
+	MaxVersion     string
+	CipherSuites   []string
+	Curves         []string
+	ALPN           []string
+	HandshakeDelay int
+	HandshakeAbort bool
+	HandshakeAlert int
+}
+
+// tlsVersions maps the TLS version names to the protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps the curve names to the key exchange curve IDs
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// apply constrains the TLS configuration to the versions, cipher suites,
+// curves and ALPN protocols specified by the policy, and validates the handshake faults
+func (policy *TLSPolicy) apply(config *tls.Config) error {
+	var err error
+
+	if config.MinVersion, err = parseTLSVersion(policy.MinVersion); err != nil {
+		return err
+	}
+
+	if config.MaxVersion, err = parseTLSVersion(policy.MaxVersion); err != nil {
+		return err
+	}
+
+	for _, name := range policy.CipherSuites {
+		id, err := parseCipherSuite(name)
+
+		if err != nil {
+			return err
+		}
+
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	for _, name := range policy.Curves {
+		curve, ok := tlsCurves[name]
+
+		if !ok {
+			return fmt.Errorf("unsupported TLS curve: %s", name)
+		}
+
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if len(policy.ALPN) > 0 {
+		config.NextProtos = policy.ALPN
+	}
+
+	// The alert is sent as a single byte: reject the codes it would truncate
+	if policy.HandshakeAlert < 0 || policy.HandshakeAlert > 255 {
+		return fmt.Errorf("invalid TLS handshake alert: %d, expected 1-255", policy.HandshakeAlert)
+	}
+
+	return nil
+}
+
+// simulateHandshakeFault delays the ServerHello, or fails the handshake
+// with an alert or an abrupt close, as specified by the policy
+func (policy *TLSPolicy) simulateHandshakeFault(conn net.Conn) error {
+	if policy.HandshakeDelay > 0 {
+		time.Sleep(time.Duration(policy.HandshakeDelay) * time.Millisecond)
+	}
+
+	if policy.HandshakeAlert > 0 {
+		// A fatal alert record: content type 21, TLS 1.2 record version, level 2
+		conn.Write([]byte{21, 3, 3, 0, 2, 2, byte(policy.HandshakeAlert)})
+		conn.Close()
+
+		return fmt.Errorf("simulated TLS handshake alert %d", policy.HandshakeAlert)
+	}
+
+	if policy.HandshakeAbort {
+		conn.Close()
+
+		return fmt.Errorf("simulated TLS handshake abort")
+	}
+
+	return nil
+}
+
+// simulateQUICHandshakeFault delays the ServerHello, or fails the QUIC handshake, as specified
+// by the policy. QUIC carries the alert in the CRYPTO_ERROR code of the connection close and,
+// as there is no TCP connection to close, the abort fails the handshake with an internal_error alert
+func (policy *TLSPolicy) simulateQUICHandshakeFault() error {
+	if policy.HandshakeDelay > 0 {
+		time.Sleep(time.Duration(policy.HandshakeDelay) * time.Millisecond)
+	}
+
+	if policy.HandshakeAlert > 0 {
+		return tls.AlertError(policy.HandshakeAlert)
+	}
+
+	if policy.HandshakeAbort {
+		return fmt.Errorf("simulated TLS handshake abort")
+	}
+
+	return nil
+}
+
+// parseTLSVersion converts the TLS version name, e.g. 1.2, into the protocol version.
+// A blank name is converted to 0, meaning the Go default
+func parseTLSVersion(name string) (uint16, error) {
+	if len(name) == 0 {
+		return 0, nil
+	}
+
+	if version, ok := tlsVersions[strings.TrimPrefix(name, "TLS")]; ok {
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("unsupported TLS version: %s", name)
+}
+
+// parseCipherSuite converts the IANA cipher suite name into the cipher suite ID
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported TLS cipher suite: %s", name)
+}
@@ -0,0 +1,204 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Rate limiting algorithms
+const (
+	RateLimitTokenBucket   = "token-bucket"
+	RateLimitFixedWindow   = "fixed-window"
+	RateLimitSlidingWindow = "sliding-window"
+)
+
+// RateLimitOptions describes the intended behavior of the rate limiting simulation in httpr:
+// up to Limit requests are allowed per Window, in seconds, for every key
+type RateLimitOptions struct {
+	Algorithm string
+	Limit     int
+	Window    int
+	Key       string
+}
+
+// RateLimitDecision is the outcome of a rate limit check
+type RateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// rateLimiter tracks the requests counted against a single rate limit key
+type rateLimiter struct {
+	lastUsed time.Time
+
+	// Fixed window
+	windowStart time.Time
+	count       int
+
+	// Sliding window: the times of the requests within the last window
+	requests []time.Time
+
+	// Token bucket
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Enabled returns true if the rate limiting simulation is enabled
+func (o *RateLimitOptions) Enabled() bool {
+	return o.Limit > 0
+}
+
+// Validate checks the rate limiting options
+func (o *RateLimitOptions) Validate() error {
+	switch o.Algorithm {
+	case RateLimitTokenBucket, RateLimitFixedWindow, RateLimitSlidingWindow:
+	default:
+		return fmt.Errorf("unsupported rate limit algorithm: %s", o.Algorithm)
+	}
+
+	if err := ValidateRequestKey(o.Key); err != nil {
+		return err
+	}
+
+	if o.Window <= 0 {
+		return fmt.Errorf("the rate limit window must be positive: %d", o.Window)
+	}
+
+	return nil
+}
+
+// CheckRateLimit counts a request against the rate limit of the key,
+// and returns whether the request is allowed along with the quota state
+func (ctx *Context) CheckRateLimit(key string, now time.Time) RateLimitDecision {
+	ctx.Mutex.Lock()
+
+	defer ctx.Mutex.Unlock()
+
+	if ctx.rateLimiters == nil {
+		ctx.rateLimiters = make(map[string]*rateLimiter)
+	}
+
+	window := time.Duration(ctx.RateLimit.Window) * time.Second
+
+	// Forget the keys idle for a whole window, at most once per window: their
+	// limiters are back to the initial state, with the full quota available
+	if now.Sub(ctx.lastRateLimitSweep) >= window {
+		for k, rl := range ctx.rateLimiters {
+			if now.Sub(rl.lastUsed) >= window {
+				delete(ctx.rateLimiters, k)
+			}
+		}
+
+		ctx.lastRateLimitSweep = now
+	}
+
+	rl, ok := ctx.rateLimiters[key]
+
+	if !ok {
+		rl = &rateLimiter{tokens: float64(ctx.RateLimit.Limit), lastRefill: now}
+		ctx.rateLimiters[key] = rl
+	}
+
+	rl.lastUsed = now
+
+	switch ctx.RateLimit.Algorithm {
+	case RateLimitTokenBucket:
+		return rl.takeToken(ctx.RateLimit.Limit, window, now)
+	case RateLimitSlidingWindow:
+		return rl.countSliding(ctx.RateLimit.Limit, window, now)
+	}
+
+	return rl.countFixed(ctx.RateLimit.Limit, window, now)
+}
+
+// countFixed counts the request in the current window, aligned to multiples of the window length
+func (rl *rateLimiter) countFixed(limit int, window time.Duration, now time.Time) RateLimitDecision {
+	if start := now.Truncate(window); !start.Equal(rl.windowStart) {
+		rl.windowStart = start
+		rl.count = 0
+	}
+
+	d := RateLimitDecision{Limit: limit, Reset: rl.windowStart.Add(window).Sub(now)}
+
+	if rl.count < limit {
+		rl.count++
+		d.Allowed = true
+	} else {
+		d.RetryAfter = d.Reset
+	}
+
+	d.Remaining = limit - rl.count
+
+	return d
+}
+
+// countSliding counts the request against the requests made within the last window
+func (rl *rateLimiter) countSliding(limit int, window time.Duration, now time.Time) RateLimitDecision {
+	expired := 0
+
+	for expired < len(rl.requests) && !rl.requests[expired].Add(window).After(now) {
+		expired++
+	}
+
+	rl.requests = rl.requests[expired:]
+
+	d := RateLimitDecision{Limit: limit}
+
+	if len(rl.requests) < limit {
+		rl.requests = append(rl.requests, now)
+		d.Allowed = true
+	}
+
+	d.Remaining = limit - len(rl.requests)
+
+	// A slot is freed when the oldest request leaves the window
+	d.Reset = rl.requests[0].Add(window).Sub(now)
+
+	if !d.Allowed {
+		d.RetryAfter = d.Reset
+	}
+
+	return d
+}
+
+// takeToken refills the bucket, holding up to limit tokens, at the rate of limit tokens
+// per window, and takes a token for the request if one is available
+func (rl *rateLimiter) takeToken(limit int, window time.Duration, now time.Time) RateLimitDecision {
+	rate := float64(limit) / window.Seconds()
+
+	rl.tokens = math.Min(float64(limit), rl.tokens+now.Sub(rl.lastRefill).Seconds()*rate)
+	rl.lastRefill = now
+
+	d := RateLimitDecision{Limit: limit}
+
+	if rl.tokens >= 1 {
+		rl.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - rl.tokens) / rate * float64(time.Second))
+	}
+
+	d.Remaining = int(rl.tokens)
+
+	// The time until the bucket is full again
+	d.Reset = time.Duration((float64(limit) - rl.tokens) / rate * float64(time.Second))
+
+	return d
+}
@@ -0,0 +1,182 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ScenarioStarted is the default initial state of the scenarios
+const ScenarioStarted = "Started"
+
+// Scenario is a named state machine: its rules only match in the given state,
+// and their responses transition the scenario to the next state
+type Scenario struct {
+	Name         string          `yaml:"name" json:"name"`
+	InitialState string          `yaml:"initialState" json:"initialState"`
+	Rules        []*ScenarioRule `yaml:"rules" json:"-"`
+	State        string          `yaml:"-" json:"state"`
+}
+
+// ScenarioRule is the response to the matching requests, available in the state
+// of the scenario. A rule without a state matches in every state
+type ScenarioRule struct {
+	State     string           `yaml:"state"`
+	Request   ScenarioRequest  `yaml:"request"`
+	Response  ScenarioResponse `yaml:"response"`
+	NextState string           `yaml:"nextState"`
+}
+
+// ScenarioRequest describes the requests matched by a rule. The path may contain
+// {name} parameters, and the empty attributes match any request
+type ScenarioRequest struct {
+	Method       string            `yaml:"method"`
+	Path         string            `yaml:"path"`
+	Query        map[string]string `yaml:"query"`
+	Headers      map[string]string `yaml:"headers"`
+	BodyContains string            `yaml:"bodyContains"`
+}
+
+// ScenarioResponse describes the response of a rule. The body is a Go text/template
+type ScenarioResponse struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	Delay   int               `yaml:"delay"`
+}
+
+// LoadScenarios reads the scenarios from a YAML or JSON file, and starts them in their initial state
+func LoadScenarios(fileName string) ([]*Scenario, error) {
+	data, err := ioutil.ReadFile(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Scenarios []*Scenario `yaml:"scenarios"`
+	}
+
+	// JSON is a subset of YAML
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+
+	for _, s := range file.Scenarios {
+		if len(s.Name) == 0 || names[s.Name] {
+			return nil, fmt.Errorf("scenario names must be unique and non-empty: %q", s.Name)
+		}
+
+		names[s.Name] = true
+
+		if len(s.InitialState) == 0 {
+			s.InitialState = ScenarioStarted
+		}
+
+		s.State = s.InitialState
+
+		for _, rule := range s.Rules {
+			if len(rule.Request.Path) > 0 && !strings.HasPrefix(rule.Request.Path, "/") {
+				return nil, fmt.Errorf("invalid path of a rule of the scenario %s: %q", s.Name, rule.Request.Path)
+			}
+
+			if rule.Response.Status == 0 {
+				rule.Response.Status = 200
+			}
+		}
+	}
+
+	return file.Scenarios, nil
+}
+
+// ApplyScenarioRule finds the first rule matching the request in the current state of its
+// scenario, and transitions the scenario to the next state of the rule. It returns the
+// scenario, the rule and the state the rule matched in, or nil if no rule matches
+func (ctx *Context) ApplyScenarioRule(matches func(rule *ScenarioRule) bool) (*Scenario, *ScenarioRule, string) {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	for _, s := range ctx.Scenarios {
+		for _, rule := range s.Rules {
+			if (len(rule.State) == 0 || rule.State == s.State) && matches(rule) {
+				state := s.State
+
+				if len(rule.NextState) > 0 {
+					s.State = rule.NextState
+				}
+
+				return s, rule, state
+			}
+		}
+	}
+
+	return nil, nil, ""
+}
+
+// ScenarioStates returns a snapshot of the scenarios and their current states
+func (ctx *Context) ScenarioStates() []Scenario {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	states := make([]Scenario, 0, len(ctx.Scenarios))
+
+	for _, s := range ctx.Scenarios {
+		states = append(states, *s)
+	}
+
+	return states
+}
+
+// SetScenarioState transitions the named scenario to the state
+func (ctx *Context) SetScenarioState(name, state string) error {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	for _, s := range ctx.Scenarios {
+		if s.Name == name {
+			s.State = state
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown scenario: %s", name)
+}
+
+// ResetScenarios returns the named scenario, or every scenario if the name is empty,
+// to the initial state
+func (ctx *Context) ResetScenarios(name string) error {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	found := false
+
+	for _, s := range ctx.Scenarios {
+		if len(name) == 0 || s.Name == name {
+			s.State = s.InitialState
+			found = true
+		}
+	}
+
+	if !found && len(name) > 0 {
+		return fmt.Errorf("unknown scenario: %s", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Failure sequence step actions
+const (
+	FailureActionStatus  = "status"
+	FailureActionTimeout = "timeout"
+	FailureActionReset   = "reset"
+)
+
+// failureStepPattern matches a failure sequence step, e.g. 503, timeout, 200x5 or 429(retry-after=2)
+var failureStepPattern = regexp.MustCompile(`^([a-z]+|\d{3})(?:\(([^)]*)\))?(?:x(\d+|\*))?$`)
+
+// FailureStep is a single step of a failure sequence: the response is repeated Count times,
+// or forever if Count is 0
+type FailureStep struct {
+	Action     string
+	StatusCode int
+	Count      int
+	RetryAfter int
+	Delay      int
+}
+
+// Failure returns true if the step simulates a failure rather than a successful response
+func (step FailureStep) Failure() bool {
+	return step.Action != FailureActionStatus || step.StatusCode >= 400
+}
+
+// String returns the step in the failure sequence syntax
+func (step FailureStep) String() string {
+	s := step.Action
+
+	if step.Action == FailureActionStatus {
+		s = strconv.Itoa(step.StatusCode)
+	}
+
+	var params []string
+
+	if step.RetryAfter > 0 {
+		params = append(params, fmt.Sprintf("retry-after=%d", step.RetryAfter))
+	}
+
+	if step.Delay > 0 {
+		params = append(params, fmt.Sprintf("delay=%d", step.Delay))
+	}
+
+	if len(params) > 0 {
+		s += "(" + strings.Join(params, ",") + ")"
+	}
+
+	if step.Count == 0 {
+		s += "x*"
+	} else if step.Count > 1 {
+		s += fmt.Sprintf("x%d", step.Count)
+	}
+
+	return s
+}
+
+// FailureSequence is a scripted sequence of responses, e.g. 503,503,timeout,200x5,429(retry-after=2),reset.
+// The sequence loops, unless the last step repeats forever, e.g. 503x2,200x*
+type FailureSequence []FailureStep
+
+// String returns the sequence in the failure sequence syntax
+func (seq *FailureSequence) String() string {
+	steps := make([]string, len(*seq))
+
+	for i, step := range *seq {
+		steps[i] = step.String()
+	}
+
+	return strings.Join(steps, ",")
+}
+
+// Set parses the failure sequence syntax, implementing the flag value interface
+func (seq *FailureSequence) Set(spec string) error {
+	parsed, err := ParseFailureSequence(spec)
+
+	if err != nil {
+		return err
+	}
+
+	*seq = parsed
+
+	return nil
+}
+
+// Type returns the flag value type name
+func (seq *FailureSequence) Type() string {
+	return "sequence"
+}
+
+// ParseFailureSequence parses the comma-separated failure sequence steps
+func ParseFailureSequence(spec string) (FailureSequence, error) {
+	var seq FailureSequence
+
+	tokens := splitSequence(spec)
+
+	for i, token := range tokens {
+		step, err := parseFailureStep(strings.TrimSpace(token))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if step.Count == 0 && i < len(tokens)-1 {
+			return nil, fmt.Errorf("only the last step of a failure sequence can repeat forever: %s", token)
+		}
+
+		seq = append(seq, step)
+	}
+
+	return seq, nil
+}
+
+// parseFailureStep parses a single failure sequence step
+func parseFailureStep(token string) (FailureStep, error) {
+	m := failureStepPattern.FindStringSubmatch(token)
+
+	if m == nil {
+		return FailureStep{}, fmt.Errorf("invalid failure sequence step: %q", token)
+	}
+
+	step := FailureStep{Action: m[1], Count: 1}
+
+	switch m[1] {
+	case FailureActionTimeout, FailureActionReset:
+	default:
+		code, err := strconv.Atoi(m[1])
+
+		if err != nil || code < 100 || code > 599 {
+			return FailureStep{}, fmt.Errorf("invalid failure sequence step: %q", token)
+		}
+
+		step.Action = FailureActionStatus
+		step.StatusCode = code
+	}
+
+	if len(m[2]) > 0 {
+		for _, param := range strings.Split(m[2], ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+			n, err := strconv.Atoi(value)
+
+			if err != nil || n < 0 {
+				return FailureStep{}, fmt.Errorf("invalid failure sequence step parameter: %q", param)
+			}
+
+			switch name {
+			case "retry-after":
+				step.RetryAfter = n
+			case "delay":
+				step.Delay = n
+			default:
+				return FailureStep{}, fmt.Errorf("unsupported failure sequence step parameter: %q", name)
+			}
+		}
+	}
+
+	if m[3] == "*" {
+		step.Count = 0
+	} else if len(m[3]) > 0 {
+		step.Count, _ = strconv.Atoi(m[3])
+
+		if step.Count == 0 {
+			return FailureStep{}, fmt.Errorf("invalid failure sequence step count: %q", token)
+		}
+	}
+
+	return step, nil
+}
+
+// splitSequence splits the sequence at the commas outside of the step parameters
+func splitSequence(spec string) []string {
+	var tokens []string
+
+	depth, start := 0, 0
+
+	for i, c := range spec {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				tokens = append(tokens, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(tokens, spec[start:])
+}
+
+// nextStep advances the failure sequence, and returns the current step
+func (fm *FailureSimulation) nextStep() FailureStep {
+	step := fm.Sequence[fm.sequenceStep]
+
+	fm.sequenceIteration++
+
+	if step.Count > 0 && fm.sequenceIteration >= step.Count {
+		fm.sequenceIteration = 0
+		fm.sequenceStep = (fm.sequenceStep + 1) % len(fm.Sequence)
+	}
+
+	fm.failureSimulated = step.Failure()
+
+	return step
+}
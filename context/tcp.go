@@ -0,0 +1,77 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// TCPProxyOptions describes the intended behavior of httpr when proxying raw TCP connections
+type TCPProxyOptions struct {
+	Upstream            string
+	Bandwidth           int
+	ResetProbability    float64
+	HalfOpenProbability float64
+}
+
+// StartTCPServer starts accepting TCP connections, serving each of them with the
+// handler in its own goroutine, and blocks until the process is interrupted
+func (ctx *Context) StartTCPServer(handle func(conn net.Conn)) {
+	listener, err := net.Listen("tcp", ctx.HttpService)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		var backoff time.Duration
+
+		for {
+			conn, err := listener.Accept()
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Keep accepting after the transient errors, e.g. running out of file descriptors,
+			// backing off as net/http does
+			if err != nil {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+
+				log.Printf("Error accepting a connection: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+
+				continue
+			}
+
+			backoff = 0
+
+			go handle(conn)
+		}
+	}()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+}
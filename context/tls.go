@@ -0,0 +1,219 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netbucket/privatetls"
+)
+
+// connContextKey is the request context key holding the underlying network connection
+type connContextKey struct{}
+
+// handshakeDurations holds the TLS handshake duration for every open connection,
+// keyed by the underlying network connection
+var handshakeDurations sync.Map
+
+// clientAuthModes maps the client authentication mode names to the TLS client auth types
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+	"verify":  tls.RequireAndVerifyClientCert,
+}
+
+// newServerTLSConfig creates the TLS configuration for the HTTPS listener
+func (ctx *Context) newServerTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+
+	if err := ctx.TLSPolicy.apply(config); err != nil {
+		return nil, err
+	}
+
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		connConfig := timedTLSConfig(config, hello.Conn)
+
+		if err := ctx.TLSPolicy.simulateHandshakeFault(hello.Conn); err != nil {
+			return nil, err
+		}
+
+		return connConfig, nil
+	}
+
+	if len(ctx.CADir) > 0 && (len(ctx.CertFile) == 0 || len(ctx.KeyFile) == 0) {
+		if err := ctx.configureLocalCA(config); err != nil {
+			return nil, err
+		}
+	} else {
+		cert, err := loadServerCertificate(ctx.CertFile, ctx.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(ctx.TLSFault) > 0 || len(ctx.TLSFaultSNI) > 0 {
+		if err := ctx.configureTLSFaults(config); err != nil {
+			return nil, err
+		}
+	}
+
+	clientAuth, err := ParseClientAuth(ctx.ClientAuth)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientAuth = clientAuth
+
+	if len(ctx.ClientCAFile) > 0 {
+		pool, err := loadCertPool(ctx.ClientCAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+	} else if clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client auth mode verify requires a client CA file")
+	}
+
+	return config, nil
+}
+
+// newQUICTLSConfig derives the TLS configuration of the HTTP/3 listener from the HTTPS one.
+// QUIC handshakes do not run over a TCP connection: their faults are simulated with QUIC
+// connection errors, and their durations are not recorded
+func (ctx *Context) newQUICTLSConfig(config *tls.Config) *tls.Config {
+	quicConfig := config.Clone()
+
+	quicConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return nil, ctx.TLSPolicy.simulateQUICHandshakeFault()
+	}
+
+	return quicConfig
+}
+
+// loadServerCertificate loads the certificate and private key files.
+// If either or both certFile and keyFile are blank, a self-signed cert is generated
+func loadServerCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return privatetls.NewCert()
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// ParseClientAuth converts the client authentication mode name into the TLS client
+// auth type. A blank name is treated as "none"
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	if len(mode) == 0 {
+		return tls.NoClientCert, nil
+	}
+
+	if clientAuth, ok := clientAuthModes[mode]; ok {
+		return clientAuth, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("unsupported client auth mode: %s", mode)
+}
+
+// loadCertPool reads the PEM-encoded certificates in the file into a certificate pool
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", fileName)
+	}
+
+	return pool, nil
+}
+
+// timedTLSConfig clones the TLS configuration for a single connection, recording
+// the duration of the handshake that starts when the ClientHello is received
+func timedTLSConfig(config *tls.Config, conn net.Conn) *tls.Config {
+	start := time.Now()
+
+	connConfig := config.Clone()
+	connConfig.GetConfigForClient = nil
+
+	verifyConnection := config.VerifyConnection
+
+	connConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		handshakeDurations.Store(conn, time.Since(start))
+
+		if verifyConnection != nil {
+			return verifyConnection(state)
+		}
+		return nil
+	}
+
+	return connConfig
+}
+
+// trackConnection stores the underlying network connection in the connection context,
+// making the handshake duration available to the HTTP handlers
+func trackConnection(ctx stdcontext.Context, c net.Conn) stdcontext.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+
+	return stdcontext.WithValue(ctx, connContextKey{}, c)
+}
+
+// forgetConnection discards the handshake duration once the connection is closed
+func forgetConnection(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		if tlsConn, ok := c.(*tls.Conn); ok {
+			c = tlsConn.NetConn()
+		}
+
+		handshakeDurations.Delete(c)
+	}
+}
+
+// HandshakeDuration returns the duration of the TLS handshake for the connection
+// the HTTP request was received on, if it is known
+func HandshakeDuration(r *http.Request) (time.Duration, bool) {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+
+	if !ok {
+		return 0, false
+	}
+
+	d, ok := handshakeDurations.Load(conn)
+
+	if !ok {
+		return 0, false
+	}
+
+	return d.(time.Duration), true
+}
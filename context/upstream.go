@@ -0,0 +1,111 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// Upstream HTTP protocols that can be forced by the proxy
+const (
+	UpstreamHTTP1 = "1.1"
+	UpstreamHTTP2 = "2"
+	UpstreamH2C   = "h2c"
+)
+
+// UpstreamOptions describes how the proxy connects to the upstream service
+type UpstreamOptions struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+	Protocol   string
+}
+
+// NewUpstreamTLSConfig creates the TLS configuration used to connect to the upstream service
+func (ctx *Context) NewUpstreamTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: ctx.IgnoreTLSErrors,
+		ServerName:         ctx.Upstream.ServerName,
+	}
+
+	if len(ctx.Upstream.CertFile) > 0 || len(ctx.Upstream.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(ctx.Upstream.CertFile, ctx.Upstream.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(ctx.Upstream.CAFile) > 0 {
+		pool, err := loadCertPool(ctx.Upstream.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// NewUpstreamTransport creates the HTTP transport used to proxy requests to the upstream
+// service, speaking the HTTP protocol version forced by the upstream options, if any
+func (ctx *Context) NewUpstreamTransport() (http.RoundTripper, error) {
+	tlsConfig, err := ctx.NewUpstreamTLSConfig()
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch ctx.Upstream.Protocol {
+	case "":
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		transport.ForceAttemptHTTP2 = true
+
+		return transport, nil
+	case UpstreamHTTP1:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		transport.ForceAttemptHTTP2 = false
+
+		// A non-nil, empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+		return transport, nil
+	case UpstreamHTTP2:
+		return &http2.Transport{TLSClientConfig: tlsConfig}, nil
+	case UpstreamH2C:
+		// Cleartext HTTP/2 with prior knowledge: dial without TLS
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(dialCtx stdcontext.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(dialCtx, network, addr)
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported upstream protocol: %s", ctx.Upstream.Protocol)
+}
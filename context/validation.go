@@ -0,0 +1,74 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package context
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/netbucket/httpr/openapi"
+)
+
+// ValidationOptions describes how httpr validates the incoming requests: against an OpenAPI
+// document, and against JSON Schemas of the request bodies keyed by "METHOD /path"
+type ValidationOptions struct {
+	OpenAPIFile string
+	Schemas     map[string]string
+	Reject      bool
+	ErrorBody   string
+	Document    *openapi.Document
+}
+
+// Enabled returns true if the request validation is enabled
+func (v *ValidationOptions) Enabled() bool {
+	return len(v.OpenAPIFile) > 0 || len(v.Schemas) > 0
+}
+
+// Strict returns true if the requests not declared in the OpenAPI document are invalid
+func (v *ValidationOptions) Strict() bool {
+	return len(v.OpenAPIFile) > 0
+}
+
+// Load reads the OpenAPI document and the JSON Schemas the requests are validated against
+func (v *ValidationOptions) Load() error {
+	v.Document = &openapi.Document{OpenAPI: "3.0.3"}
+
+	if len(v.OpenAPIFile) > 0 {
+		doc, err := openapi.Load(v.OpenAPIFile)
+
+		if err != nil {
+			return err
+		}
+
+		v.Document = doc
+	}
+
+	for route, fileName := range v.Schemas {
+		method, path, ok := strings.Cut(strings.TrimSpace(route), " ")
+
+		if !ok || !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid schema route, expected METHOD /path: %q", route)
+		}
+
+		schema, err := openapi.LoadSchema(fileName)
+
+		if err != nil {
+			return err
+		}
+
+		v.Document.SetRequestSchema(method, path, schema)
+	}
+
+	return nil
+}
@@ -0,0 +1,407 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// Limits of the httpbin-compatible endpoints, matching httpbin
+const (
+	binMaxDelay  = 10
+	binMaxBytes  = 100 * 1024
+	binMaxStream = 100
+)
+
+// binMaxMemory is the memory used to parse the multipart form bodies, the rest is stored on disk
+const binMaxMemory = 32 << 20
+
+// binModel is the echo response of the httpbin-compatible endpoints: the logged request model, with
+// the headers, url and origin of the request in httpbin's shape. The repeated query parameters and
+// headers are the only ones with list and comma-joined values
+type binModel struct {
+	requestModel
+	Args    map[string]interface{} `json:"args"`
+	Headers map[string]string      `json:"headers"`
+	Origin  string                 `json:"origin"`
+	URL     string                 `json:"url"`
+	ID      *int                   `json:"id,omitempty"`
+	Gzipped bool                   `json:"gzipped,omitempty"`
+}
+
+// binBodyModel is the echo response of the httpbin-compatible endpoints accepting a body
+type binBodyModel struct {
+	binModel
+	Data  string                 `json:"data"`
+	Files map[string]interface{} `json:"files"`
+	Form  map[string]interface{} `json:"form"`
+	JSON  interface{}            `json:"json"`
+}
+
+// BinHandler returns a handler function that implements the common httpbin endpoints,
+// mounted at the prefix configured in the context: /status/{code}, /delay/{n}, /bytes/{n}, /stream/{n}, /redirect/{n},
+// /get, /headers, /ip, /user-agent, /anything, /gzip and /basic-auth/{user}/{passwd}
+func BinHandler(ctx *context.Context, h http.Handler) http.Handler {
+	prefix := strings.TrimSuffix(ctx.BinPrefix, "/")
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status/{codes}", binStatus(prefix))
+	mux.HandleFunc("/delay/{n}", binDelay)
+	mux.HandleFunc("/bytes/{n}", binBytes)
+	mux.HandleFunc("/stream/{n}", binStream)
+	mux.HandleFunc("/redirect/{n}", binRedirect(prefix))
+	mux.HandleFunc("GET /get", binGet)
+	mux.HandleFunc("/anything", binAnything)
+	mux.HandleFunc("/anything/{path...}", binAnything)
+	mux.HandleFunc("GET /headers", binHeaders)
+	mux.HandleFunc("GET /ip", binIP)
+	mux.HandleFunc("GET /user-agent", binUserAgent)
+	mux.HandleFunc("GET /gzip", binGzip)
+	mux.HandleFunc("GET /basic-auth/{user}/{passwd}", binBasicAuth)
+
+	var bin http.Handler = mux
+
+	if len(prefix) > 0 {
+		bin = http.StripPrefix(prefix, mux)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bin.ServeHTTP(w, r)
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// newBinModel captures the echo response attributes of the request from its request model
+func newBinModel(r *http.Request) binModel {
+	model := binModel{requestModel: newRequestModel(r), Args: binValues(r.URL.Query()), Origin: clientIP(r)}
+
+	model.Headers = map[string]string{"Host": model.Host}
+
+	for name, values := range model.Header {
+		model.Headers[name] = strings.Join(values, ",")
+	}
+
+	// The headers are echoed in httpbin's shape only
+	model.Header = nil
+
+	scheme := "http"
+
+	if model.TLS != nil {
+		scheme = "https"
+	}
+
+	// The request URI is left intact by the prefix stripping
+	uri := model.requestModel.URL
+
+	if len(uri) == 0 {
+		uri = r.URL.RequestURI()
+	}
+
+	model.URL = scheme + "://" + model.Host + uri
+
+	return model
+}
+
+// newBinBodyModel captures the echo response attributes of the request, along with its body:
+// the form fields and files of form bodies, or the data, parsed if it is JSON, of the others
+func newBinBodyModel(r *http.Request) binBodyModel {
+	model := binBodyModel{binModel: newBinModel(r), Files: map[string]interface{}{}, Form: map[string]interface{}{}}
+
+	// The body is echoed in httpbin's shape only
+	data := model.Body
+	model.Body = ""
+
+	if r.Body == nil {
+		return model
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err == nil {
+			model.Form = binValues(r.PostForm)
+		}
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(binMaxMemory); err == nil {
+			model.Form = binValues(r.MultipartForm.Value)
+			model.Files = binFiles(r.MultipartForm.File)
+		}
+	default:
+		model.Data = data
+
+		if err := json.Unmarshal([]byte(data), &model.JSON); err != nil {
+			model.JSON = nil
+		}
+	}
+
+	return model
+}
+
+// binValues converts the values to the httpbin representation: a string for the single
+// values, and a list for the repeated ones
+func binValues(values url.Values) map[string]interface{} {
+	m := make(map[string]interface{}, len(values))
+
+	for name, v := range values {
+		if len(v) == 1 {
+			m[name] = v[0]
+		} else {
+			m[name] = v
+		}
+	}
+
+	return m
+}
+
+// binFiles reads the contents of the uploaded files, in the httpbin representation
+func binFiles(files map[string][]*multipart.FileHeader) map[string]interface{} {
+	values := make(url.Values)
+
+	for name, headers := range files {
+		for _, header := range headers {
+			f, err := header.Open()
+
+			if err != nil {
+				continue
+			}
+
+			data, _ := ioutil.ReadAll(f)
+			f.Close()
+
+			values.Add(name, string(data))
+		}
+	}
+
+	return binValues(values)
+}
+
+// clientIP returns the IP address of the client
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// writeBinJSON writes the value as an indented JSON response, as httpbin does
+func writeBinJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// pathInt parses the integer path parameter, capping it at the maximum
+func pathInt(w http.ResponseWriter, r *http.Request, name string, max int) (int, bool) {
+	n, err := strconv.Atoi(r.PathValue(name))
+
+	if err != nil || n < 0 {
+		http.Error(w, fmt.Sprintf("Invalid %s: %q", name, r.PathValue(name)), http.StatusBadRequest)
+		return 0, false
+	}
+
+	if max > 0 && n > max {
+		n = max
+	}
+
+	return n, true
+}
+
+// binStatus replies with the status code, or a random one of the comma-separated status codes
+func binStatus(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		codes := strings.Split(r.PathValue("codes"), ",")
+
+		code, err := strconv.Atoi(codes[rand.Intn(len(codes))])
+
+		if err != nil || code < 100 || code > 599 {
+			http.Error(w, "Invalid status code", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case code == http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+		case code >= 300 && code < 400 && code != http.StatusNotModified:
+			w.Header().Set("Location", prefix+"/redirect/1")
+		}
+
+		w.WriteHeader(code)
+	}
+}
+
+// binDelay replies with the echo response after n seconds
+func binDelay(w http.ResponseWriter, r *http.Request) {
+	n, ok := pathInt(w, r, "n", binMaxDelay)
+
+	if !ok {
+		return
+	}
+
+	select {
+	case <-time.After(time.Duration(n) * time.Second):
+		writeBinJSON(w, http.StatusOK, newBinBodyModel(r))
+	case <-r.Context().Done():
+	}
+}
+
+// binBytes replies with n random bytes, reproducible with the seed query parameter
+func binBytes(w http.ResponseWriter, r *http.Request) {
+	n, ok := pathInt(w, r, "n", binMaxBytes)
+
+	if !ok {
+		return
+	}
+
+	seed := time.Now().UnixNano()
+
+	if s, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64); err == nil {
+		seed = s
+	}
+
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// binStream streams n echo responses, one JSON document per line
+func binStream(w http.ResponseWriter, r *http.Request) {
+	n, ok := pathInt(w, r, "n", binMaxStream)
+
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	model := newBinModel(r)
+	flusher, _ := w.(http.Flusher)
+
+	for i := 0; i < n; i++ {
+		id := i
+		model.ID = &id
+
+		line, _ := json.Marshal(model)
+		w.Write(append(line, '\n'))
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// binRedirect redirects n times, ending at /get
+func binRedirect(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, ok := pathInt(w, r, "n", 0)
+
+		if !ok {
+			return
+		}
+
+		if n == 0 {
+			http.Error(w, "Invalid n: 0", http.StatusBadRequest)
+			return
+		}
+
+		location := prefix + "/get"
+
+		if n > 1 {
+			location = fmt.Sprintf("%s/redirect/%d", prefix, n-1)
+		}
+
+		http.Redirect(w, r, location, http.StatusFound)
+	}
+}
+
+// binGet replies with the echo response
+func binGet(w http.ResponseWriter, r *http.Request) {
+	writeBinJSON(w, http.StatusOK, newBinModel(r))
+}
+
+// binAnything replies with the echo response, including the request method and body
+func binAnything(w http.ResponseWriter, r *http.Request) {
+	writeBinJSON(w, http.StatusOK, newBinBodyModel(r))
+}
+
+// binHeaders replies with the request headers
+func binHeaders(w http.ResponseWriter, r *http.Request) {
+	writeBinJSON(w, http.StatusOK, map[string]map[string]string{"headers": newBinModel(r).Headers})
+}
+
+// binIP replies with the client IP address
+func binIP(w http.ResponseWriter, r *http.Request) {
+	writeBinJSON(w, http.StatusOK, map[string]string{"origin": clientIP(r)})
+}
+
+// binUserAgent replies with the client user agent
+func binUserAgent(w http.ResponseWriter, r *http.Request) {
+	writeBinJSON(w, http.StatusOK, map[string]string{"user-agent": r.UserAgent()})
+}
+
+// binGzip replies with the gzip-encoded echo response
+func binGzip(w http.ResponseWriter, r *http.Request) {
+	model := newBinModel(r)
+	model.Gzipped = true
+
+	body, _ := json.MarshalIndent(model, "", "  ")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+
+	gz := gzip.NewWriter(w)
+	gz.Write(append(body, '\n'))
+	gz.Close()
+}
+
+// binBasicAuth challenges the client for HTTP Basic authentication with the user and password
+func binBasicAuth(w http.ResponseWriter, r *http.Request) {
+	user, passwd, ok := r.BasicAuth()
+
+	if !ok || user != r.PathValue("user") || passwd != r.PathValue("passwd") {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeBinJSON(w, http.StatusOK, map[string]interface{}{"authenticated": true, "user": user})
+}
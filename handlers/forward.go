@@ -0,0 +1,176 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// tunnelDialTimeout is the timeout for connecting to the destination of a CONNECT tunnel
+const tunnelDialTimeout = 10 * time.Second
+
+// ForwardProxyHandler returns a handler function that acts as an explicit HTTP
+// proxy: requests with an absolute URI are forwarded to their destination, and
+// CONNECT requests are tunneled. Delays and failures are applied per destination host
+func ForwardProxyHandler(ctx *context.Context, h http.Handler) http.Handler {
+	transport, err := ctx.NewUpstreamTransport()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		// The request URI is already absolute: forward it as is
+		Director:  func(r *http.Request) {},
+		Transport: transport,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+			http.Error(w, "Not a proxy request: the request URI must be absolute", http.StatusBadRequest)
+		} else if simulateDestinationFaults(ctx, w, r) {
+			if r.Method == http.MethodConnect && ctx.ForwardProxy.Intercept {
+				interceptConnect(ctx, transport, w, r)
+			} else if r.Method == http.MethodConnect {
+				tunnelConnect(ctx, w, r)
+			} else {
+				proxy.ServeHTTP(w, r)
+			}
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// destinationHost returns the host name, without the port, the proxy request is destined to
+func destinationHost(r *http.Request) string {
+	host := r.Host
+
+	if r.Method != http.MethodConnect && len(r.URL.Host) > 0 {
+		host = r.URL.Host
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+
+	return host
+}
+
+// simulateDestinationFaults logs the destination, and applies the delay and the
+// failure simulation configured for the destination host. It returns false if
+// a failure was simulated, and the request must not be forwarded
+func simulateDestinationFaults(ctx *context.Context, w http.ResponseWriter, r *http.Request) bool {
+	host := destinationHost(r)
+
+	ctx.Out.Write([]byte(fmt.Sprintf("Proxy destination: %s %s\n", r.Method, host)))
+
+	delay, ok := ctx.ForwardProxy.HostDelays[host]
+
+	if !ok {
+		delay = ctx.Delay
+	}
+
+	if delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+
+	if !ctx.FailureSimulationEnabled() || !ctx.ForwardProxy.FailsHost(host) {
+		return true
+	}
+
+	if statusCode, failed := ctx.SimulateFailureFor(host); failed {
+		w.WriteHeader(statusCode)
+		return false
+	}
+
+	return true
+}
+
+// tunnelConnect connects to the destination of the CONNECT request, and relays
+// the bytes between the client and the destination until either side closes
+func tunnelConnect(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
+	destination, err := net.DialTimeout("tcp", r.Host, tunnelDialTimeout)
+
+	if err != nil {
+		log.Printf("Error connecting to %s: %v", r.Host, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	defer destination.Close()
+
+	hj, ok := w.(http.Hijacker)
+
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	client, brw, err := hj.Hijack()
+
+	if err != nil {
+		log.Printf("Error accepting the tunnel connection: %v", err)
+		return
+	}
+
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var sent, received int64
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		// Bytes the client sent along with the CONNECT request are buffered in the reader
+		sent, _ = io.Copy(destination, brw.Reader)
+		closeWrite(destination)
+	}()
+
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, destination)
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+
+	ctx.Out.Write([]byte(fmt.Sprintf("Tunnel to %s closed: %d bytes sent, %d bytes received\n", r.Host, sent, received)))
+}
+
+// closeWrite shuts down the writing side of the connection, if supported,
+// signaling the end of the stream while still allowing the peer to reply
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// grpcMessageModel describes a single length-prefixed gRPC message
+type grpcMessageModel struct {
+	Length     int  `json:"length"`
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// grpcCallModel is the loggable representation of a gRPC call
+type grpcCallModel struct {
+	Service  string             `json:"service,omitempty"`
+	Method   string             `json:"method,omitempty"`
+	Messages []grpcMessageModel `json:"messages,omitempty"`
+	Trailer  http.Header        `json:"trailer,omitempty"`
+}
+
+// isGRPCRequest determines if the HTTP request is a gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// decodeGRPCCall decodes the service and method names from the request path. The
+// message framing is decoded as the body is read, see watchGRPCMessages
+func decodeGRPCCall(r *http.Request) *grpcCallModel {
+	call := &grpcCallModel{}
+
+	if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2); len(parts) == 2 {
+		call.Service, call.Method = parts[0], parts[1]
+	}
+
+	return call
+}
+
+// grpcMessageDecoder decodes the gRPC message framing of a body written in chunks
+type grpcMessageDecoder struct {
+	header    []byte
+	remaining int
+	messages  []grpcMessageModel
+}
+
+// Write decodes the framing of the next chunk of the body
+func (d *grpcMessageDecoder) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if d.remaining > 0 {
+			skip := min(d.remaining, len(p))
+			d.remaining -= skip
+			p = p[skip:]
+			continue
+		}
+
+		read := min(5-len(d.header), len(p))
+		d.header = append(d.header, p[:read]...)
+		p = p[read:]
+
+		if len(d.header) == 5 {
+			length := int(binary.BigEndian.Uint32(d.header[1:5]))
+
+			d.messages = append(d.messages, grpcMessageModel{Length: length, Compressed: d.header[0] == 1})
+			d.remaining = length
+			d.header = d.header[:0]
+		}
+	}
+
+	return n, nil
+}
+
+// watchGRPCMessages decodes the gRPC message framing of the request body as it is read,
+// without buffering the body, and logs the messages and the trailers when the body ends
+func watchGRPCMessages(ctx *context.Context, r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+
+	r.Body = &grpcMessageLogger{ReadCloser: r.Body, ctx: ctx, r: r, call: decodeGRPCCall(r)}
+}
+
+// drainGRPCRequest reads the rest of the gRPC request body once the response headers
+// are sent, so that the messages the next handlers did not read are logged as well
+func drainGRPCRequest(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Body.(*grpcMessageLogger); ok {
+		http.NewResponseController(w).Flush()
+		io.Copy(io.Discard, r.Body)
+	}
+}
+
+// grpcMessageLogger logs the gRPC messages and trailers of the request body when it ends
+type grpcMessageLogger struct {
+	io.ReadCloser
+	ctx     *context.Context
+	r       *http.Request
+	call    *grpcCallModel
+	decoder grpcMessageDecoder
+	once    sync.Once
+}
+
+// Read the request body, decoding the message framing
+func (l *grpcMessageLogger) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+
+	l.decoder.Write(p[:n])
+
+	if err != nil {
+		l.log()
+	}
+
+	return n, err
+}
+
+// Close the request body, logging the messages read so far
+func (l *grpcMessageLogger) Close() error {
+	l.log()
+	return l.ReadCloser.Close()
+}
+
+// log writes the messages and the trailers of the request, once
+func (l *grpcMessageLogger) log() {
+	l.once.Do(func() {
+		l.call.Messages = l.decoder.messages
+
+		// Trailers are only available once the request body has been read
+		if len(l.r.Trailer) > 0 {
+			l.call.Trailer = l.r.Trailer
+		}
+
+		if l.ctx.LogJSON || l.ctx.LogPrettyJSON {
+			var body []byte
+			var err error
+
+			model := requestModel{URL: l.r.RequestURI, GRPC: l.call}
+
+			if l.ctx.LogPrettyJSON {
+				body, err = json.MarshalIndent(model, "", "    ")
+			} else {
+				body, err = json.Marshal(model)
+			}
+
+			if err == nil {
+				l.ctx.Out.Write(append(body, []byte("\n")...))
+			}
+			return
+		}
+
+		l.ctx.Out.Write([]byte(fmt.Sprintf("gRPC request to %s:\n", l.r.URL.Path)))
+		l.ctx.Out.Write(formatGRPCMessages(l.call))
+	})
+}
+
+// formatGRPCCall formats the gRPC call summary for the plain text log
+func formatGRPCCall(call *grpcCallModel) []byte {
+	return []byte(fmt.Sprintf("gRPC service: %s\ngRPC method: %s\n\n", call.Service, call.Method))
+}
+
+// formatGRPCMessages formats the gRPC messages and trailers for the plain text log
+func formatGRPCMessages(call *grpcCallModel) []byte {
+	var buf bytes.Buffer
+
+	for i, m := range call.Messages {
+		fmt.Fprintf(&buf, "gRPC message %d: %d bytes", i+1, m.Length)
+
+		if m.Compressed {
+			buf.WriteString(" (compressed)")
+		}
+
+		buf.WriteString("\n")
+	}
+
+	for k, v := range call.Trailer {
+		fmt.Fprintf(&buf, "gRPC trailer %s: %s\n", k, strings.Join(v, ", "))
+	}
+
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
+
+// writeGRPCStatus writes a trailers-only style gRPC response carrying the
+// status code and message in the grpc-status and grpc-message trailers
+func writeGRPCStatus(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+
+	if len(message) > 0 {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
+
+// grpcResponseLogger returns a proxy response hook that logs the trailers
+// of the upstream gRPC responses once the response body has been relayed
+func grpcResponseLogger(ctx *context.Context) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc") {
+			resp.Body = &grpcTrailerLogger{ReadCloser: resp.Body, ctx: ctx, resp: resp}
+		}
+		return nil
+	}
+}
+
+// grpcTrailerLogger logs the gRPC status trailers when the body reaches EOF
+type grpcTrailerLogger struct {
+	io.ReadCloser
+	ctx    *context.Context
+	resp   *http.Response
+	logged bool
+}
+
+// Read the response body, logging the trailers at the end of the body
+func (l *grpcTrailerLogger) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+
+	if err == io.EOF && !l.logged {
+		l.logged = true
+
+		status := l.resp.Trailer.Get("Grpc-Status")
+
+		// A trailers-only response carries the status in the headers
+		if len(status) == 0 {
+			status = l.resp.Header.Get("Grpc-Status")
+		}
+
+		l.ctx.Out.Write([]byte(fmt.Sprintf("gRPC response from %s: grpc-status=%s grpc-message=%q\n",
+			l.resp.Request.URL.Path, status, l.resp.Trailer.Get("Grpc-Message"))))
+	}
+
+	return n, err
+}
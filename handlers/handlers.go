@@ -15,36 +15,68 @@ package handlers
 
 import (
 	"bytes"
-	"crypto/tls"
+	stdcontext "context"
 	"fmt"
 	"github.com/netbucket/httpr/context"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"path"
+	"strings"
+	"time"
 )
 
 // RawRequestLoggingHandler returns a handler function that logs the incoming
 // HTTP request in plain text format
 func RawRequestLoggingHandler(ctx *context.Context, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, err := httputil.DumpRequest(r, true)
+		grpc := isGRPCRequest(r)
+
+		body, err := httputil.DumpRequest(r, !grpc)
 
 		if err == nil {
 			body = append(body, []byte("\n")...)
 
+			// gRPC bodies are binary: log the call, and the message framing once the body is read
+			if grpc {
+				body = append(body, formatGRPCCall(decodeGRPCCall(r))...)
+			}
+
+			if r.TLS != nil {
+				body = append(body, formatTLS(newTLSModel(r))...)
+			}
+
+			if errs := validationErrorsOf(r); len(errs) > 0 {
+				body = append(body, formatValidationErrors(errs)...)
+			}
+
 			ctx.Out.Write([]byte(fmt.Sprintf("Remote address: %s\n", r.RemoteAddr)))
 
+			if r.TLS != nil {
+				ctx.Out.Write(formatCertificates(newCertificateModels(r.TLS.PeerCertificates)))
+			}
+
 			ctx.Out.Write(body)
 
-			if ctx.Echo && !ctx.FailureSimulated() {
+			// The echo of a gRPC call would not be a valid gRPC response
+			if ctx.Echo && !grpc && !failureSimulated(ctx, r) {
 				w.Write(body)
 			}
 		}
 
+		if grpc {
+			watchGRPCMessages(ctx, r)
+		}
+
 		if h != nil {
 			h.ServeHTTP(w, r)
 		}
+
+		if grpc {
+			drainGRPCRequest(w, r)
+		}
 	})
 }
 
@@ -52,6 +84,8 @@ func RawRequestLoggingHandler(ctx *context.Context, h http.Handler) http.Handler
 // HTTP request in a compact or formatted JSON format
 func JSONRequestLoggingHandler(ctx *context.Context, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grpc := isGRPCRequest(r)
+
 		body, err := EncodeAsJSON(r, ctx.LogPrettyJSON)
 
 		if err != nil {
@@ -60,21 +94,33 @@ func JSONRequestLoggingHandler(ctx *context.Context, h http.Handler) http.Handle
 			body = append(body, []byte("\n")...)
 			ctx.Out.Write(body)
 
-			if ctx.Echo && !ctx.FailureSimulated() {
+			// The echo of a gRPC call would not be a valid gRPC response
+			if ctx.Echo && !grpc && !failureSimulated(ctx, r) {
 				w.Write(body)
 			}
 		}
 
+		if grpc {
+			watchGRPCMessages(ctx, r)
+		}
+
 		if h != nil {
 			h.ServeHTTP(w, r)
 		}
+
+		if grpc {
+			drainGRPCRequest(w, r)
+		}
 	})
 }
 
 // ContentTypeHandler will set the correct content type for the HTTP response
 func ContentTypeHandler(ctx *context.Context, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if ctx.LogJSON || ctx.LogPrettyJSON {
+		if ctx.Stream.Mode == StreamSSE {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else if ctx.LogJSON || ctx.LogPrettyJSON {
 			w.Header().Set("Content-Type", "application/json")
 		}
 
@@ -88,7 +134,11 @@ func ContentTypeHandler(ctx *context.Context, h http.Handler) http.Handler {
 // responding to the HTTP request
 func DelayHandler(ctx *context.Context, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx.SimulateDelay()
+		if o := overridesOf(r); o != nil && o.hasDelay {
+			time.Sleep(time.Duration(o.delay) * time.Millisecond)
+		} else {
+			ctx.SimulateDelay()
+		}
 
 		if h != nil {
 			h.ServeHTTP(w, r)
@@ -100,7 +150,14 @@ func DelayHandler(ctx *context.Context, h http.Handler) http.Handler {
 // HTTP status code
 func ResponseCodeHandler(ctx *context.Context, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(ctx.HttpCode)
+		// The response was already written if the request was rejected, e.g. by the validation
+		if !failureSimulated(ctx, r) {
+			if isGRPCRequest(r) {
+				writeGRPCStatus(w, ctx.GRPCStatus, "")
+			} else {
+				w.WriteHeader(ctx.HttpCode)
+			}
+		}
 
 		if h != nil {
 			h.ServeHTTP(w, r)
@@ -113,12 +170,41 @@ func ResponseCodeHandler(ctx *context.Context, h http.Handler) http.Handler {
 // by a series of successful HTTP status codes
 func FailureSimulationHandler(ctx *context.Context, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		statusCode := ctx.SimulateFailure()
+		// The outcome was already decided, e.g. the request was rejected by the validation
+		if _, decided := r.Context().Value(failureOutcomeKey{}).(bool); decided {
+			if h != nil {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		statusCode, failed, proceed := simulateRequestFailure(ctx, w, r)
+
+		if !proceed {
+			return
+		}
+
+		o := overridesOf(r)
+
+		if !failed && o != nil && o.status > 0 {
+			statusCode = o.status
+		}
 
-		// Don't write the HTTP status header if this is a proxy mode,
+		// Let the next handlers know the outcome for this request, as other
+		// requests may advance the failure simulation concurrently
+		r = r.WithContext(stdcontext.WithValue(r.Context(), failureOutcomeKey{}, failed))
+
+		// Don't write the HTTP status header if this is a proxy, file serving or mock mode,
 		// and the last simulation returned a successful outcome
-		if ctx.UpstreamURL == nil || ctx.FailureSimulated() {
-			w.WriteHeader(statusCode)
+		if !ctx.ResponseDelegated() || failed {
+			if !isGRPCRequest(r) {
+				w.WriteHeader(statusCode)
+			} else if failed {
+				// gRPC clients ignore the HTTP status code: report the failure in the trailers
+				writeGRPCStatus(w, ctx.FailureMode.GRPCStatus, http.StatusText(statusCode))
+			} else {
+				writeGRPCStatus(w, ctx.GRPCStatus, "")
+			}
 		}
 
 		if h != nil {
@@ -127,27 +213,115 @@ func FailureSimulationHandler(ctx *context.Context, h http.Handler) http.Handler
 	})
 }
 
+// simulateRequestFailure decides the outcome of the request: as requested by the override
+// headers, by the next step of the failure sequence, or by the failure simulation, tracked per
+// request key if configured. It returns the status code, whether a failure was simulated, and
+// false if the request was consumed by a timeout or a reset, and must not be handled any further
+func simulateRequestFailure(ctx *context.Context, w http.ResponseWriter, r *http.Request) (int, bool, bool) {
+	key := requestKey(ctx.FailureMode.Key, r)
+
+	if o := overridesOf(r); o != nil && o.fail != nil {
+		// The request headers decide the outcome, leaving the failure simulation untouched
+		if !simulateFailureStep(ctx, w, r, *o.fail) {
+			return 0, false, false
+		}
+
+		return o.fail.StatusCode, o.fail.Failure(), true
+	}
+
+	if len(ctx.FailureMode.Sequence) > 0 {
+		var step context.FailureStep
+
+		if ctx.FailureKeyed() {
+			step = ctx.SimulateFailureStepFor(key)
+		} else {
+			step = ctx.SimulateFailureStep()
+		}
+
+		if !simulateFailureStep(ctx, w, r, step) {
+			return 0, false, false
+		}
+
+		return step.StatusCode, step.Failure(), true
+	}
+
+	if ctx.FailureKeyed() {
+		statusCode, failed := ctx.SimulateFailureFor(key)
+		return statusCode, failed, true
+	}
+
+	statusCode := ctx.SimulateFailure()
+
+	return statusCode, ctx.FailureSimulated(), true
+}
+
+// failureOutcomeKey is the request context key of the failure simulation outcome
+type failureOutcomeKey struct{}
+
+// failureSimulated returns true if a failure was simulated for the request
+func failureSimulated(ctx *context.Context, r *http.Request) bool {
+	if failed, ok := r.Context().Value(failureOutcomeKey{}).(bool); ok {
+		return failed
+	}
+
+	return ctx.FailureSimulated()
+}
+
 // ProxyHandler returns a handler function that forwards the incoming
 // HTTP request to an upstream HTTP service
 func ProxyHandler(ctx *context.Context, h http.Handler) http.Handler {
 	proxy := httputil.NewSingleHostReverseProxy(ctx.UpstreamURL)
 
-	if ctx.IgnoreTLSErrors {
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	director := proxy.Director
+
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		stripOverrideHeaders(ctx, r.Header)
 	}
 
+	transport, err := ctx.NewUpstreamTransport()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxy.Transport = transport
+
+	proxy.ModifyResponse = proxyResponseLogger(ctx)
+
 	return proxyHostHandler(proxy, h)
 }
 
+// proxyResponseLogger returns a proxy response hook that logs the gRPC status trailers and,
+// if configured, the upstream responses. gRPC and event stream bodies are relayed as they
+// arrive, and are not logged
+func proxyResponseLogger(ctx *context.Context) func(*http.Response) error {
+	logGRPCResponse := grpcResponseLogger(ctx)
+
+	if !ctx.LogResponses {
+		return logGRPCResponse
+	}
+
+	logResponse := responseLogger(ctx)
+
+	return func(resp *http.Response) error {
+		contentType := resp.Header.Get("Content-Type")
+
+		if strings.HasPrefix(contentType, "application/grpc") || strings.HasPrefix(contentType, "text/event-stream") {
+			return logGRPCResponse(resp)
+		}
+
+		return logResponse(resp)
+	}
+}
+
 // proxyHostHandler will set the host in the upstream request to the URL host
 // This will ensure correct HTTP request proxying behavior
 func proxyHostHandler(proxy http.Handler, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.Host = r.URL.Host
 
-		if !context.Instance().FailureSimulated() {
+		if !failureSimulated(context.Instance(), r) {
 			proxy.ServeHTTP(w, r)
 		}
 
@@ -157,6 +331,63 @@ func proxyHostHandler(proxy http.Handler, h http.Handler) http.Handler {
 	})
 }
 
+// FileServerHandler returns a handler function that serves the files
+// in the directory specified by the context, including range requests
+func FileServerHandler(ctx *context.Context, h http.Handler) http.Handler {
+	var fs http.FileSystem = http.Dir(ctx.ServeDir)
+
+	if !ctx.ListDirs {
+		fs = noListingFileSystem{fs}
+	}
+
+	fileServer := http.FileServer(fs)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failureSimulated(ctx, r) {
+			fileServer.ServeHTTP(w, r)
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// noListingFileSystem is a file system that hides the contents of directories
+// without an index.html file, preventing http.FileServer from listing them
+type noListingFileSystem struct {
+	fs http.FileSystem
+}
+
+// Open the named file, refusing to open directories that lack an index.html file
+func (nfs noListingFileSystem) Open(name string) (http.File, error) {
+	f, err := nfs.fs.Open(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		index, err := nfs.fs.Open(path.Join(name, "index.html"))
+
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+
+		index.Close()
+	}
+
+	return f, nil
+}
+
 // copyRequestBody makes a non-destructive copy of the HTTP request body contents
 // to make the contents available for repeated use by multiple HTTP handlers
 func copyRequestBody(r *http.Request) []byte {
@@ -14,9 +14,27 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/openapi"
+	"github.com/netbucket/privatetls"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -138,3 +156,1450 @@ func TestJSONContentType(t *testing.T) {
 		t.Errorf("Expected content type %s, got %s", expectedContentType, contentType)
 	}
 }
+
+func TestResponseTemplateHandler(t *testing.T) {
+	expectedBody := `POST /orders/42 abc 7 42`
+
+	req, err := http.NewRequest("POST", "/orders/42?ref=abc", strings.NewReader(`{"qty": 7}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+
+	ctx := &context.Context{
+		Mutex:        &sync.Mutex{},
+		FailureMode:  context.FailureSimulation{Enabled: false},
+		ResponseBody: `{{.Method}} {{.Path}} {{.Query.Get "ref"}} {{.JSON.qty}} {{index .PathParams 1}}`}
+
+	ResponseTemplateHandler(ctx, nil).ServeHTTP(rec, req)
+
+	if body := rec.Body.String(); body != expectedBody {
+		t.Errorf("Expected response body %q, got %q", expectedBody, body)
+	}
+}
+
+func TestResponseTemplateInvalidLength(t *testing.T) {
+	for _, body := range []string{`{{randHex -1}}`, `{{randString -1}}`} {
+		tmpl, err := NewResponseTemplate(body, "")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := RenderResponseTemplate(tmpl, httptest.NewRequest("GET", "/", nil)); err == nil {
+			t.Errorf("Expected an error rendering %q", body)
+		}
+	}
+}
+
+func TestFileServerHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "fixture.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		FailureMode: context.FailureSimulation{Enabled: false},
+		ServeDir:    dir}
+
+	h := FileServerHandler(ctx, nil)
+
+	req := httptest.NewRequest("GET", "/fixture.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("Expected HTTP status %d with body %q, got %d with body %q",
+			http.StatusPartialContent, "234", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/sub/", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected HTTP status %d for a directory listing, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestWebSocketEchoHandler(t *testing.T) {
+	const expectedCloseCode = 4001
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         io.Discard,
+		FailureMode: context.FailureSimulation{Enabled: false},
+		WebSocket:   context.WebSocketSimulation{CloseAfter: 1, CloseCode: expectedCloseCode}}
+
+	server := httptest.NewServer(WebSocketEchoHandler(ctx, nil))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n\r\n", server.Listener.Addr(), key)
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected WebSocket handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	writeWebSocketFrame(conn, &wsFrame{Fin: true, Opcode: wsOpText, Masked: true,
+		Mask: [4]byte{1, 2, 3, 4}, Payload: []byte("hello")})
+
+	f, err := readWebSocketFrame(reader, DefaultWebSocketMaxFrameSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Opcode != wsOpText || string(f.Payload) != "hello" {
+		t.Errorf("Expected text frame %q, got opcode %d with %q", "hello", f.Opcode, f.Payload)
+	}
+
+	f, err = readWebSocketFrame(reader, DefaultWebSocketMaxFrameSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Opcode != wsOpClose || binary.BigEndian.Uint16(f.Payload) != expectedCloseCode {
+		t.Errorf("Expected close frame with code %d, got opcode %d with %v", expectedCloseCode, f.Opcode, f.Payload)
+	}
+}
+
+func TestWebSocketMaxFrameSize(t *testing.T) {
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard, WebSocket: context.WebSocketSimulation{MaxFrameSize: 16}}
+
+	server := httptest.NewServer(WebSocketEchoHandler(ctx, nil))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", server.Listener.Addr())
+
+	reader := bufio.NewReader(conn)
+
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected WebSocket handshake response: %v %v", resp, err)
+	}
+
+	// A masked binary frame header claiming a 2^62 bytes payload, without the payload
+	header := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+	binary.BigEndian.PutUint64(header[2:10], 1<<62)
+
+	conn.Write(header)
+
+	f, err := readWebSocketFrame(reader, DefaultWebSocketMaxFrameSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Opcode != wsOpClose || binary.BigEndian.Uint16(f.Payload) != wsCloseMessageTooBig {
+		t.Errorf("Expected close frame with code %d, got opcode %d with %v", wsCloseMessageTooBig, f.Opcode, f.Payload)
+	}
+
+	if _, err := readWebSocketFrame(reader, DefaultWebSocketMaxFrameSize); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestWebSocketUpgradeFailures(t *testing.T) {
+	ctx := &context.Context{
+		Mutex: &sync.Mutex{},
+		Out:   io.Discard,
+		FailureMode: context.FailureSimulation{Enabled: true, FailureCount: 1, SuccessCount: 1,
+			FailureCode: http.StatusServiceUnavailable, Key: "header:X-Test-Id"},
+		RateLimit: context.RateLimitOptions{Algorithm: context.RateLimitFixedWindow, Limit: 4, Window: 60, Key: context.RequestKeyGlobal}}
+
+	server := httptest.NewServer(RateLimitHandler(ctx, OverrideHandler(ctx, WebSocketEchoHandler(ctx, nil))))
+	defer server.Close()
+
+	tests := []struct {
+		headers      string
+		expectedCode int
+	}{
+		// The failures are tracked per key
+		{"X-Test-Id: a\r\n", http.StatusServiceUnavailable},
+		{"X-Test-Id: b\r\n", http.StatusServiceUnavailable},
+		{"X-Test-Id: a\r\n", http.StatusSwitchingProtocols},
+		{"X-Test-Id: a\r\nX-Httpr-Fail: 502\r\n", http.StatusBadGateway},
+		{"X-Test-Id: b\r\n", http.StatusTooManyRequests},
+	}
+
+	for i, test := range tests {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s\r\n",
+			server.Listener.Addr(), test.headers)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != test.expectedCode {
+			t.Errorf("Upgrade %d: expected HTTP status %d, got %d", i, test.expectedCode, resp.StatusCode)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	expectedBody := "id: 3\ndata: event 3\n\nid: 4\ndata: event 4\n\n"
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Last-Event-ID", "2")
+
+	rec := httptest.NewRecorder()
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		FailureMode: context.FailureSimulation{Enabled: false},
+		Stream: context.StreamSimulation{
+			Mode: StreamSSE, Count: 4, Data: "event {{.ID}}"}}
+
+	StreamHandler(ctx, nil).ServeHTTP(rec, req)
+
+	if body := rec.Body.String(); body != expectedBody {
+		t.Errorf("Expected stream %q, got %q", expectedBody, body)
+	}
+
+	if !rec.Flushed {
+		t.Error("Expected the stream to be flushed")
+	}
+}
+
+func TestGRPCFailureSimulation(t *testing.T) {
+	const expectedGRPCStatus = "14"
+
+	req := httptest.NewRequest("POST", "/helloworld.Greeter/SayHello",
+		bytes.NewReader([]byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}))
+	req.Header.Set("Content-Type", "application/grpc")
+
+	rec := httptest.NewRecorder()
+
+	ctx := &context.Context{
+		Mutex: &sync.Mutex{},
+		FailureMode: context.FailureSimulation{
+			Enabled: true, FailureCount: 1, FailureCode: 503, GRPCStatus: 14}}
+
+	FailureSimulationHandler(ctx, nil).ServeHTTP(rec, req)
+
+	resp := rec.Result()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected HTTP status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if status := resp.Trailer.Get("Grpc-Status"); status != expectedGRPCStatus {
+		t.Errorf("Expected grpc-status trailer %s, got %q", expectedGRPCStatus, status)
+	}
+
+	call := decodeGRPCCall(req)
+
+	if call.Service != "helloworld.Greeter" || call.Method != "SayHello" {
+		t.Errorf("Unexpected gRPC call decoded: %+v", call)
+	}
+}
+
+func TestGRPCStreamingRequestLogging(t *testing.T) {
+	var out bytes.Buffer
+
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: &out, Echo: true}
+
+	body, stream := io.Pipe()
+
+	req := httptest.NewRequest("POST", "/helloworld.Greeter/SayHelloStream", body)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	rec := httptest.NewRecorder()
+
+	replied := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		RawRequestLoggingHandler(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeGRPCStatus(w, 0, "")
+			close(replied)
+		})).ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	// The reply must not wait for the end of the streamed request body
+	stream.Write([]byte{0, 0, 0, 0, 3, 'a', 'b', 'c'})
+
+	select {
+	case <-replied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the reply before the end of the request body")
+	}
+
+	stream.Write([]byte{1, 0, 0, 0, 2, 'd'})
+	stream.Write([]byte{'e'})
+	stream.Close()
+
+	<-done
+
+	if rec.Header().Get("Content-Type") != "application/grpc" || rec.Body.Len() > 0 {
+		t.Errorf("Expected a gRPC response without the echo, got %v %q", rec.Header(), rec.Body.String())
+	}
+
+	if logged := out.String(); !strings.Contains(logged, "gRPC method: SayHelloStream\n") ||
+		!strings.Contains(logged, "gRPC message 1: 3 bytes\ngRPC message 2: 2 bytes (compressed)\n") {
+		t.Errorf("Unexpected log: %q", logged)
+	}
+}
+
+func TestClientCertificateLogging(t *testing.T) {
+	clientCert, err := privatetls.NewCert()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         &out,
+		FailureMode: context.FailureSimulation{Enabled: false},
+		LogJSON:     true}
+
+	server := httptest.NewUnstartedServer(JSONRequestLoggingHandler(ctx, nil))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+
+	resp, err := client.Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if !strings.Contains(out.String(), `"clientCertificates":[{"subject":"O=PrivateTLS"`) {
+		t.Errorf("Expected the client certificate in the log, got %s", out.String())
+	}
+}
+
+func TestTLSSessionLogging(t *testing.T) {
+	var out bytes.Buffer
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         &out,
+		FailureMode: context.FailureSimulation{Enabled: false}}
+
+	server := httptest.NewTLSServer(RawRequestLoggingHandler(ctx, nil))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if !strings.Contains(out.String(), "TLS: version=TLS 1.3 cipher=TLS_") {
+		t.Errorf("Expected the TLS session details in the log, got %s", out.String())
+	}
+}
+
+func TestProxyHandlerUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.TLS.ServerName)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	tests := map[string]string{
+		context.UpstreamHTTP1: "HTTP/1.1 example.com",
+		context.UpstreamHTTP2: "HTTP/2.0 example.com",
+	}
+
+	for protocol, expectedBody := range tests {
+		ctx := &context.Context{
+			Mutex:       &sync.Mutex{},
+			FailureMode: context.FailureSimulation{Enabled: false},
+			UpstreamURL: upstreamURL,
+			Upstream: context.UpstreamOptions{
+				CAFile: caFile, ServerName: "example.com", Protocol: protocol}}
+
+		rec := httptest.NewRecorder()
+
+		ProxyHandler(ctx, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if body := rec.Body.String(); body != expectedBody {
+			t.Errorf("Expected upstream response %q, got %q (HTTP status %d)", expectedBody, body, rec.Code)
+		}
+	}
+}
+
+func TestForwardProxyHandler(t *testing.T) {
+	const expectedFailureResponse = 503
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	ctx := &context.Context{
+		Mutex: &sync.Mutex{},
+		Out:   io.Discard,
+		FailureMode: context.FailureSimulation{
+			Enabled: true, FailureCount: 1, SuccessCount: 1, FailureCode: expectedFailureResponse},
+		HttpCode: http.StatusOK}
+
+	proxy := httptest.NewServer(ForwardProxyHandler(ctx, nil))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// The failure sequence is tracked independently for every destination host
+	tests := []struct {
+		host         string
+		expectedCode int
+	}{
+		{"127.0.0.1", expectedFailureResponse},
+		{"localhost", expectedFailureResponse},
+		{"127.0.0.1", http.StatusOK},
+		{"localhost", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		resp, err := client.Get("http://" + net.JoinHostPort(test.host, port) + "/")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expectedCode {
+			t.Errorf("Expected HTTP status %d for %s, got %d", test.expectedCode, test.host, resp.StatusCode)
+		}
+	}
+}
+
+func TestForwardProxyInterception(t *testing.T) {
+	done := make(chan struct{})
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			// The stream is only over once the client has received the first event
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: 1\n\n")
+			w.(http.Flusher).Flush()
+			<-done
+			return
+		}
+
+		io.WriteString(w, "upstream secret")
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	var out bytes.Buffer
+
+	ctx := &context.Context{
+		Mutex:           &sync.Mutex{},
+		Out:             &out,
+		CADir:           t.TempDir(),
+		IgnoreTLSErrors: true,
+		LogResponses:    true,
+		ForwardProxy:    context.ForwardProxyOptions{Intercept: true}}
+
+	// Create the local CA, so the client can trust the intercepting certificates
+	if _, err := ctx.InterceptionCertificate("localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM, err := os.ReadFile(filepath.Join(ctx.CADir, "ca.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	proxy := httptest.NewServer(ForwardProxyHandler(ctx, nil))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	resp, err := client.Get("https://" + net.JoinHostPort("localhost", port) + "/secret")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "upstream secret" {
+		t.Errorf("Expected the upstream response, got %q", body)
+	}
+
+	logged := out.String()
+
+	if !strings.Contains(logged, "GET /secret") || !strings.Contains(logged, "upstream secret") {
+		t.Errorf("Expected the decrypted request and response to be logged, got:\n%s", logged)
+	}
+
+	// Event streams are relayed as they arrive
+	client.Timeout = 5 * time.Second
+
+	resp, err = client.Get("https://" + net.JoinHostPort("localhost", port) + "/events")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := bufio.NewReader(resp.Body).ReadString('\n')
+	resp.Body.Close()
+
+	if event != "data: 1\n" {
+		t.Errorf("Expected the first event before the end of the stream, got %q (%v)", event, err)
+	}
+}
+
+// pipelinedConn sends the CONNECT request along with the first bytes written to the tunnel,
+// and skips the response of the proxy before the first read
+type pipelinedConn struct {
+	net.Conn
+	connect []byte
+	reader  *bufio.Reader
+}
+
+func (c *pipelinedConn) Write(p []byte) (int, error) {
+	if c.connect != nil {
+		data := append(c.connect, p...)
+		c.connect = nil
+
+		if _, err := c.Conn.Write(data); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	return c.Conn.Write(p)
+}
+
+func (c *pipelinedConn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
+
+		for {
+			line, err := c.reader.ReadString('\n')
+
+			if err != nil {
+				return 0, err
+			}
+
+			if line == "\r\n" {
+				break
+			}
+		}
+	}
+
+	return c.reader.Read(p)
+}
+
+func TestForwardProxyInterceptionPipelined(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream secret")
+	}))
+	defer upstream.Close()
+
+	ctx := &context.Context{
+		Mutex:           &sync.Mutex{},
+		Out:             io.Discard,
+		CADir:           t.TempDir(),
+		IgnoreTLSErrors: true,
+		ForwardProxy:    context.ForwardProxyOptions{Intercept: true}}
+
+	proxy := httptest.NewServer(ForwardProxyHandler(ctx, nil))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	destination := net.JoinHostPort("localhost", port)
+
+	// The ClientHello is sent in the same write as the CONNECT request
+	tlsConn := tls.Client(&pipelinedConn{
+		Conn:    conn,
+		connect: []byte("CONNECT " + destination + " HTTP/1.1\r\nHost: " + destination + "\r\n\r\n"),
+	}, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+
+	req, _ := http.NewRequest("GET", "https://"+destination+"/secret", nil)
+
+	if err := req.Write(tlsConn); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "upstream secret" {
+		t.Errorf("Expected the upstream response, got %q", body)
+	}
+}
+
+func TestTCPProxyHandler(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer upstream.Close()
+
+	// Echo everything back to the client
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		options      context.TCPProxyOptions
+		expectedEcho bool
+		expectedLog  string
+	}{
+		{context.TCPProxyOptions{}, true, "5 bytes sent, 5 bytes received"},
+		{context.TCPProxyOptions{ResetProbability: 1}, false, "reset"},
+		{context.TCPProxyOptions{HalfOpenProbability: 1}, false, "5 bytes discarded"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		test.options.Upstream = upstream.Addr().String()
+
+		ctx := &context.Context{Out: &out, TCPProxy: test.options}
+
+		client, proxy := net.Pipe()
+		done := make(chan struct{})
+
+		go func() {
+			TCPProxyHandler(ctx)(proxy)
+			close(done)
+		}()
+
+		client.Write([]byte("hello"))
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(client, buf)
+
+		if test.expectedEcho && (err != nil || string(buf) != "hello") {
+			t.Errorf("Expected the data to be echoed, got %q, %v", buf, err)
+		} else if !test.expectedEcho && err == nil {
+			t.Errorf("Expected the data not to be relayed, got %q", buf)
+		}
+
+		client.Close()
+		<-done
+
+		if !strings.Contains(out.String(), test.expectedLog) {
+			t.Errorf("Expected the log to contain %q, got %q", test.expectedLog, out.String())
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	ctx := &context.Context{
+		Mutex: &sync.Mutex{},
+		Out:   io.Discard,
+		RateLimit: context.RateLimitOptions{
+			Algorithm: context.RateLimitFixedWindow, Limit: 1, Window: 60, Key: "header:X-Client"}}
+
+	tests := []struct {
+		client       string
+		expectedCode int
+	}{
+		{"a", http.StatusOK},
+		{"b", http.StatusOK},
+		{"a", http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Client", test.client)
+		rec := httptest.NewRecorder()
+
+		RateLimitHandler(ctx, nil).ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode {
+			t.Errorf("Expected HTTP status %d for client %s, got %d", test.expectedCode, test.client, rec.Code)
+		}
+
+		if rec.Header().Get("RateLimit-Limit") != "1" || rec.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("Unexpected RateLimit headers: %v", rec.Header())
+		}
+
+		retryAfter := rec.Header().Get("Retry-After")
+
+		if test.expectedCode == http.StatusTooManyRequests && (len(retryAfter) == 0 || retryAfter == "0") {
+			t.Errorf("Expected a Retry-After header, got %q", retryAfter)
+		}
+	}
+}
+
+func TestFailureSequenceSimulation(t *testing.T) {
+	seq, err := context.ParseFailureSequence("503,429(retry-after=2),reset,200x*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         io.Discard,
+		FailureMode: context.FailureSimulation{Sequence: seq},
+		HttpCode:    http.StatusOK}
+
+	server := httptest.NewServer(FailureSimulationHandler(ctx, nil))
+	defer server.Close()
+
+	tests := []struct {
+		expectedCode       int
+		expectedRetryAfter string
+	}{
+		{http.StatusServiceUnavailable, ""},
+		{http.StatusTooManyRequests, "2"},
+		{0, ""},
+		{http.StatusOK, ""},
+		{http.StatusOK, ""},
+	}
+
+	// Go clients transparently retry requests reset on reused connections
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	for i, test := range tests {
+		resp, err := client.Get(server.URL)
+
+		if test.expectedCode == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("Step %d: expected the connection to be reset, got HTTP status %d", i, resp.StatusCode)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expectedCode || resp.Header.Get("Retry-After") != test.expectedRetryAfter {
+			t.Errorf("Step %d: expected HTTP status %d and Retry-After %q, got %d and %q", i,
+				test.expectedCode, test.expectedRetryAfter, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestKeyedFailureSimulation(t *testing.T) {
+	ctx := &context.Context{
+		Mutex: &sync.Mutex{},
+		Out:   io.Discard,
+		FailureMode: context.FailureSimulation{
+			Enabled: true, FailureCount: 1, SuccessCount: 1, FailureCode: 503, Key: "header:X-Test-Id"},
+		HttpCode: http.StatusOK}
+
+	h := FailureSimulationHandler(ctx, nil)
+
+	// Interleaved clients don't consume each other's failures
+	tests := []struct {
+		testID       string
+		expectedCode int
+	}{
+		{"1", 503},
+		{"2", 503},
+		{"1", 200},
+		{"2", 200},
+		{"3", 503},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Test-Id", test.testID)
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode {
+			t.Errorf("Expected HTTP status %d for test %s, got %d", test.expectedCode, test.testID, rec.Code)
+		}
+	}
+}
+
+func TestOverrideHandler(t *testing.T) {
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         io.Discard,
+		FailureMode: context.FailureSimulation{FailureCode: 503},
+		HttpCode:    http.StatusOK}
+
+	h := OverrideHandler(ctx, FailureSimulationHandler(ctx, ResponseTemplateHandler(ctx, nil)))
+
+	tests := []struct {
+		headers      map[string]string
+		expectedCode int
+		expectedBody string
+	}{
+		{map[string]string{}, http.StatusOK, ""},
+		{map[string]string{"X-Httpr-Status": "201", "X-Httpr-Body": "created"}, http.StatusCreated, "created"},
+		{map[string]string{"X-Httpr-Fail": "true", "X-Httpr-Body": "ignored"}, 503, ""},
+		{map[string]string{"X-Httpr-Fail": "429(retry-after=2)"}, http.StatusTooManyRequests, ""},
+		{map[string]string{"X-Httpr-Status": "abc"}, http.StatusBadRequest, "invalid X-Httpr-Status header: \"abc\"\n"},
+		{map[string]string{"X-Httpr-Delay": "3600000"}, http.StatusBadRequest, "the X-Httpr-Delay header exceeds the maximum delay of 60000 ms\n"},
+		{map[string]string{"X-Httpr-Fail": "503(delay=3600000)"}, http.StatusBadRequest, "the X-Httpr-Fail header exceeds the maximum delay of 60000 ms\n"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode || rec.Body.String() != test.expectedBody {
+			t.Errorf("Expected HTTP status %d and body %q for %v, got %d and %q",
+				test.expectedCode, test.expectedBody, test.headers, rec.Code, rec.Body.String())
+		}
+	}
+
+	// The overrides don't affect the other requests
+	if ctx.HttpCode != http.StatusOK || ctx.FailureSimulated() {
+		t.Error("Expected the context to be left untouched by the overrides")
+	}
+}
+
+func TestOverrideNoFailure(t *testing.T) {
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         io.Discard,
+		FailureMode: context.FailureSimulation{FailureCode: 503},
+		HttpCode:    http.StatusServiceUnavailable}
+
+	var failed bool
+
+	h := OverrideHandler(ctx, FailureSimulationHandler(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed = failureSimulated(ctx, r)
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Httpr-Fail", "false")
+
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if failed || rec.Code != http.StatusOK {
+		t.Errorf("Expected X-Httpr-Fail: false to never fail, got %d and failure %v", rec.Code, failed)
+	}
+}
+
+func TestProxyOverrides(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Httpr-") {
+				io.WriteString(w, name)
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	ctx := &context.Context{
+		Mutex:       &sync.Mutex{},
+		Out:         io.Discard,
+		UpstreamURL: upstreamURL,
+		HttpCode:    http.StatusOK}
+
+	h := OverrideHandler(ctx, FailureSimulationHandler(ctx, ProxyHandler(ctx, nil)))
+
+	tests := []struct {
+		headers      map[string]string
+		expectedCode int
+		expectedBody string
+	}{
+		// The override headers are not forwarded upstream
+		{map[string]string{"X-Httpr-Delay": "0", "X-Httpr-Trace": "1"}, http.StatusOK, ""},
+		{map[string]string{"X-Httpr-Status": "201"}, http.StatusBadRequest, "the X-Httpr-Status header is not supported in this mode\n"},
+		{map[string]string{"X-Httpr-Body": "created"}, http.StatusBadRequest, "the X-Httpr-Body header is not supported in this mode\n"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode || rec.Body.String() != test.expectedBody {
+			t.Errorf("Expected HTTP status %d and body %q for %v, got %d and %q",
+				test.expectedCode, test.expectedBody, test.headers, rec.Code, rec.Body.String())
+		}
+	}
+}
+func TestBinHandler(t *testing.T) {
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard, BinPrefix: "/bin"}
+
+	server := httptest.NewServer(BinHandler(ctx, nil))
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	tests := []struct {
+		path             string
+		expectedCode     int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{"/bin/status/418", http.StatusTeapot, "", ""},
+		{"/bin/redirect/2", http.StatusFound, "/bin/redirect/1", ""},
+		{"/bin/redirect/1", http.StatusFound, "/bin/get", ""},
+		{"/bin/get?a=1", http.StatusOK, "", `"args": {
+    "a": "1"
+  }`},
+		{"/bin/get?a=1&a=2", http.StatusOK, "", `"args": {
+    "a": [
+      "1",
+      "2"
+    ]
+  }`},
+		{"/bin/anything/x", http.StatusOK, "", `"url": "` + server.URL + `/bin/anything/x"`},
+		{"/bin/ip", http.StatusOK, "", `"origin": "127.0.0.1"`},
+		{"/bin/basic-auth/user/passwd", http.StatusUnauthorized, "", ""},
+		{"/bin/bytes/abc", http.StatusBadRequest, "", ""},
+		{"/status/200", http.StatusNotFound, "", ""},
+	}
+
+	for _, test := range tests {
+		resp, err := client.Get(server.URL + test.path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expectedCode || resp.Header.Get("Location") != test.expectedLocation ||
+			!strings.Contains(string(body), test.expectedBody) {
+			t.Errorf("Unexpected response for %s: %d %q\n%s", test.path, resp.StatusCode, resp.Header.Get("Location"), body)
+		}
+	}
+
+	// Random bytes are reproducible with a seed, and gzip responses are decoded by the client
+	var previous []byte
+
+	for _, path := range []string{"/bin/bytes/16?seed=1", "/bin/bytes/16?seed=1", "/bin/gzip"} {
+		resp, err := http.Get(server.URL + path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if strings.HasPrefix(path, "/bin/bytes") && (len(body) != 16 || (previous != nil && !bytes.Equal(body, previous))) {
+			t.Errorf("Expected 16 reproducible random bytes, got %v", body)
+		} else if path == "/bin/gzip" && !strings.Contains(string(body), `"gzipped": true`) {
+			t.Errorf("Expected a gzipped echo response, got %s", body)
+		}
+
+		previous = body
+	}
+}
+
+func TestBinBodyModel(t *testing.T) {
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard}
+
+	server := httptest.NewServer(BinHandler(ctx, nil))
+	defer server.Close()
+
+	var multipartBody bytes.Buffer
+
+	mw := multipart.NewWriter(&multipartBody)
+	mw.WriteField("name", "value")
+	fw, _ := mw.CreateFormFile("upload", "upload.txt")
+	io.WriteString(fw, "file contents")
+	mw.Close()
+
+	tests := []struct {
+		contentType string
+		body        string
+		expected    map[string]interface{}
+	}{
+		{"application/json", `{"id": 1}`, map[string]interface{}{
+			"data": `{"id": 1}`, "json": map[string]interface{}{"id": float64(1)},
+			"form": map[string]interface{}{}, "files": map[string]interface{}{}}},
+		{"application/x-www-form-urlencoded", "a=1&a=2&b=3", map[string]interface{}{
+			"data": "", "json": nil, "files": map[string]interface{}{},
+			"form": map[string]interface{}{"a": []interface{}{"1", "2"}, "b": "3"}}},
+		{mw.FormDataContentType(), multipartBody.String(), map[string]interface{}{
+			"data": "", "json": nil,
+			"form":  map[string]interface{}{"name": "value"},
+			"files": map[string]interface{}{"upload": "file contents"}}},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Post(server.URL+"/anything?q=1", test.contentType, strings.NewReader(test.body))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var model map[string]interface{}
+
+		err = json.NewDecoder(resp.Body).Decode(&model)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{"args", "data", "files", "form", "headers", "json", "method", "origin", "url", "remoteAddr", "proto"} {
+			if _, ok := model[key]; !ok {
+				t.Errorf("Expected the %q key in the response to %s, got %v", key, test.contentType, model)
+			}
+		}
+
+		// The request model headers and body are echoed in httpbin's shape only
+		for _, key := range []string{"header", "body"} {
+			if _, ok := model[key]; ok {
+				t.Errorf("Unexpected %q key in the response to %s, got %v", key, test.contentType, model)
+			}
+		}
+
+		for key, expected := range test.expected {
+			if !reflect.DeepEqual(model[key], expected) {
+				t.Errorf("Expected %q to be %v for %s, got %v", key, expected, test.contentType, model[key])
+			}
+		}
+
+		headers, _ := model["headers"].(map[string]interface{})
+
+		if model["url"] != server.URL+"/anything?q=1" || model["method"] != "POST" || headers["Content-Type"] != test.contentType {
+			t.Errorf("Unexpected url, method or headers for %s: %v", test.contentType, model)
+		}
+	}
+}
+
+func TestMockHandler(t *testing.T) {
+	doc, err := openapi.Parse([]byte(`
+openapi: 3.0.3
+info: {title: Pets, version: "1.0"}
+paths:
+  /pets/{id}:
+    get:
+      responses:
+        "200":
+          description: A pet
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  id: {type: integer, example: 42}
+            text/plain:
+              example: a pet
+        "404":
+          description: Not found
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard, OpenAPI: doc}
+
+	tests := []struct {
+		method              string
+		path                string
+		headers             map[string]string
+		expectedCode        int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"GET", "/pets/1", nil, http.StatusOK, "application/json", `{"id":42}`},
+		{"GET", "/pets/1", map[string]string{"Accept": "text/*"}, http.StatusOK, "text/plain", "a pet"},
+		{"GET", "/pets/1", map[string]string{"Prefer": "code=404"}, http.StatusNotFound, "", ""},
+		{"DELETE", "/pets/1", nil, http.StatusMethodNotAllowed, "text/plain; charset=utf-8", "DELETE is not declared for /pets/{id}\n"},
+		{"GET", "/owners", nil, http.StatusNotFound, "text/plain; charset=utf-8", "No path of the OpenAPI specification matches /owners\n"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		rec := httptest.NewRecorder()
+
+		MockHandler(ctx, nil).ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode || rec.Header().Get("Content-Type") != test.expectedContentType ||
+			rec.Body.String() != test.expectedBody {
+			t.Errorf("Unexpected response for %s %s %v: %d %q %q", test.method, test.path, test.headers,
+				rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+	}
+}
+
+func TestMockResponseSelection(t *testing.T) {
+	doc, err := openapi.Parse([]byte(`
+openapi: 3.0.3
+info: {title: Orders, version: "1.0"}
+paths:
+  /orders:
+    post:
+      responses:
+        "201":
+          description: Created
+          content:
+            application/json: {example: {id: 1}}
+        default:
+          description: Error
+          content:
+            application/json: {example: {error: boom}}
+  /carts:
+    post:
+      responses:
+        "201":
+          description: Created
+          content:
+            application/json: {example: {id: 2}}
+        2XX:
+          description: Success
+          content:
+            application/json: {example: {ok: true}}
+        4XX:
+          description: Client error
+          content:
+            application/json: {example: {error: bad}}
+  /errors:
+    post:
+      responses:
+        default:
+          description: Error
+          content:
+            application/json: {example: {error: boom}}
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard, OpenAPI: doc}
+
+	tests := []struct {
+		path         string
+		prefer       string
+		expectedCode int
+		expectedBody string
+	}{
+		{"/orders", "", http.StatusCreated, `{"id":1}`},
+		// The default response never matches a preferred code
+		{"/orders", "code=200", http.StatusCreated, `{"id":1}`},
+		{"/carts", "", http.StatusCreated, `{"id":2}`},
+		{"/carts", "code=202", http.StatusAccepted, `{"ok":true}`},
+		{"/carts", "code=409", http.StatusConflict, `{"error":"bad"}`},
+		{"/errors", "", http.StatusOK, `{"error":"boom"}`},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.path, nil)
+
+		if len(test.prefer) > 0 {
+			req.Header.Set("Prefer", test.prefer)
+		}
+
+		rec := httptest.NewRecorder()
+
+		MockHandler(ctx, nil).ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode || rec.Body.String() != test.expectedBody {
+			t.Errorf("Unexpected response for %s %q: %d %q", test.path, test.prefer, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestValidationHandler(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "order.schema.json")
+
+	if err := os.WriteFile(schemaFile, []byte(`{"type":"object","required":["item"],"properties":{"item":{"type":"string"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		reject       bool
+		errorBody    string
+		body         string
+		expectedCode int
+		expectedBody string
+		expectedLog  string
+	}{
+		{false, "", `{"item":"book"}`, http.StatusOK, "", ""},
+		{false, "", `{"item":1}`, http.StatusOK, "", "Validation errors:\n  - body.item: expected string, got number\n"},
+		{true, "", `{}`, http.StatusBadRequest, `{"error":"Request validation failed","errors":["body.item: required"]}`, "  - body.item: required\n"},
+		{true, "{{.Method}} {{.Path}}: {{index .Errors 0}}", `{}`, http.StatusBadRequest, "POST /orders: body.item: required", "  - body.item: required\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		ctx := &context.Context{Mutex: &sync.Mutex{}, Out: &out, HttpCode: http.StatusOK}
+		ctx.Validation.Schemas = map[string]string{"POST /orders": schemaFile}
+		ctx.Validation.Reject = test.reject
+		ctx.Validation.ErrorBody = test.errorBody
+
+		if err := ctx.Validation.Load(); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+
+		ValidationHandler(ctx, ResponseCodeHandler(ctx, RawRequestLoggingHandler(ctx, nil))).ServeHTTP(rec, req)
+
+		if rec.Code != test.expectedCode || rec.Body.String() != test.expectedBody {
+			t.Errorf("Unexpected response for %s: %d %q", test.body, rec.Code, rec.Body.String())
+		}
+
+		if logged := out.String(); !strings.Contains(logged, test.body) || !strings.Contains(logged, test.expectedLog) ||
+			(len(test.expectedLog) == 0 && strings.Contains(logged, "Validation errors")) {
+			t.Errorf("Unexpected log for %s: %q", test.body, logged)
+		}
+	}
+
+	// Requests of routes without a schema are not validated
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard}
+	ctx.Validation.Schemas = map[string]string{"POST /orders": schemaFile}
+	ctx.Validation.Load()
+
+	if errs := validateRequest(ctx, httptest.NewRequest("GET", "/orders", nil)); len(errs) > 0 {
+		t.Errorf("Unexpected validation errors: %v", errs)
+	}
+}
+
+func TestReadTraffic(t *testing.T) {
+	traffic := `Starting the server
+{"method":"GET","url":"/orders/1","header":{"Accept":["application/json"]}}
+{"method":"GET","url":"/orders/2"}
+{
+    "method": "GET",
+    "url": "http://localhost:9000/api/orders/2",
+    "statusCode": 404
+}
+{"method":"GET","url":"http://localhost:9000/api/orders/1","statusCode":200,"body":"{\"id\":1}"}
+{"method":"POST","url":"/orders","body":"{}"}
+`
+
+	exchanges, err := ReadTraffic(strings.NewReader(traffic))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exchanges) != 3 {
+		t.Fatalf("Expected 3 requests, got %+v", exchanges)
+	}
+
+	if e := exchanges[0]; e.URL != "/orders/1" || e.StatusCode != 200 || e.ResponseBody != `{"id":1}` ||
+		e.RequestHeader.Get("Accept") != "application/json" {
+		t.Errorf("Unexpected exchange: %+v", e)
+	}
+
+	if e := exchanges[1]; e.URL != "/orders/2" || e.StatusCode != 404 {
+		t.Errorf("Unexpected exchange: %+v", e)
+	}
+
+	if e := exchanges[2]; e.Method != "POST" || e.RequestBody != "{}" || e.StatusCode != 0 {
+		t.Errorf("Unexpected exchange: %+v", e)
+	}
+}
+
+func TestScenarioHandler(t *testing.T) {
+	doc, err := openapi.Parse([]byte(`
+openapi: 3.0.3
+info: {title: Orders, version: "1.0"}
+paths:
+  /health:
+    get:
+      responses:
+        "204": {description: Healthy}
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &context.Context{Mutex: &sync.Mutex{}, Out: io.Discard, OpenAPI: doc, Scenarios: []*context.Scenario{{
+		Name: "order", InitialState: context.ScenarioStarted, State: context.ScenarioStarted,
+		Rules: []*context.ScenarioRule{
+			{
+				State:     context.ScenarioStarted,
+				Request:   context.ScenarioRequest{Method: "POST", Path: "/orders", BodyContains: "book"},
+				Response:  context.ScenarioResponse{Status: http.StatusCreated, Body: `{{.JSON.item}} {{.State}} -> {{.NextState}}`},
+				NextState: "Pending",
+			},
+			{
+				State:    "Pending",
+				Request:  context.ScenarioRequest{Method: "GET", Path: "/orders/{id}"},
+				Response: context.ScenarioResponse{Status: http.StatusOK, Body: "order {{.Params.id}}"},
+			},
+		},
+	}}}
+
+	h := ScenarioAdminHandler(ctx, ScenarioHandler(ctx, MockHandler(ctx, nil)))
+
+	tests := []struct {
+		method       string
+		path         string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"GET", "/orders/1", "", http.StatusNotFound, "No path of the OpenAPI specification matches /orders/1\n"},
+		{"POST", "/orders", `{"item":"pen"}`, http.StatusNotFound, "No path of the OpenAPI specification matches /orders\n"},
+		{"POST", "/orders", `{"item":"book"}`, http.StatusCreated, "book Started -> Pending"},
+		{"GET", "/orders/1", "", http.StatusOK, "order 1"},
+		{"GET", "/health", "", http.StatusNoContent, ""},
+		{"PUT", "/__httpr/scenarios/order/state", `{"state":"Started"}`, http.StatusOK, ""},
+		{"GET", "/orders/1", "", http.StatusNotFound, "No path of the OpenAPI specification matches /orders/1\n"},
+		{"POST", "/__httpr/scenarios/payment/reset", "", http.StatusNotFound, "unknown scenario: payment\n"},
+	}
+
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+
+		if rec.Code != test.expectedCode || (len(test.expectedBody) > 0 && rec.Body.String() != test.expectedBody) {
+			t.Errorf("Unexpected response to request %d (%s %s): %d %q", i, test.method, test.path, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/__httpr/scenarios", nil))
+
+	if !strings.Contains(rec.Body.String(), `"state": "Started"`) {
+		t.Errorf("Unexpected scenario states: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// responseModel is the loggable representation of an HTTP response
+type responseModel struct {
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Proto      string      `json:"proto,omitempty"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// interceptConnect terminates the TLS connection tunneled by the CONNECT request using
+// a certificate issued by the local CA, logs the decrypted requests and responses,
+// and forwards the requests over a new TLS connection to the real destination
+func interceptConnect(ctx *context.Context, transport http.RoundTripper, w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+
+	if err != nil {
+		log.Printf("Error accepting the tunnel connection: %v", err)
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+
+	// The ClientHello the client sent along with the CONNECT request is buffered in the reader
+	client := &bufferedConn{Conn: conn, reader: brw.Reader}
+
+	destination := r.Host
+	host := destinationHost(r)
+
+	tlsConn := tls.Server(client, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if len(hello.ServerName) > 0 {
+				return ctx.InterceptionCertificate(hello.ServerName)
+			}
+			return ctx.InterceptionCertificate(host)
+		},
+	})
+
+	s := &http.Server{Handler: interceptionHandlerChain(ctx, transport, destination)}
+
+	listener := newOneConnListener(tlsConn)
+
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			listener.Close()
+		}
+	}
+
+	s.Serve(listener)
+}
+
+// interceptionHandlerChain creates the handler chain that logs the decrypted requests,
+// and forwards them with the transport to the destination of the intercepted tunnel
+func interceptionHandlerChain(ctx *context.Context, transport http.RoundTripper, destination string) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = destination
+		},
+		Transport:      transport,
+		ModifyResponse: proxyResponseLogger(ctx),
+	}
+
+	var h http.Handler = proxy
+
+	if ctx.LogJSON || ctx.LogPrettyJSON {
+		h = JSONRequestLoggingHandler(ctx, h)
+	} else {
+		h = RawRequestLoggingHandler(ctx, h)
+	}
+
+	return h
+}
+
+// responseLogger returns a proxy response hook that logs the upstream responses
+func responseLogger(ctx *context.Context) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if ctx.LogJSON || ctx.LogPrettyJSON {
+			model := responseModel{
+				Method:     resp.Request.Method,
+				URL:        resp.Request.URL.String(),
+				Proto:      resp.Proto,
+				StatusCode: resp.StatusCode,
+				Header:     resp.Header,
+			}
+
+			if resp.Body != nil {
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if err != nil {
+					return err
+				}
+
+				// Restore the body so it can still be relayed to the client
+				resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+				model.Body = string(body)
+			}
+
+			var body []byte
+			var err error
+
+			if ctx.LogPrettyJSON {
+				body, err = json.MarshalIndent(model, "", "    ")
+			} else {
+				body, err = json.Marshal(model)
+			}
+
+			if err == nil {
+				ctx.Out.Write(append(body, []byte("\n")...))
+			}
+
+			return nil
+		}
+
+		if body, err := httputil.DumpResponse(resp, true); err == nil {
+			ctx.Out.Write([]byte(fmt.Sprintf("Response from: %s\n", resp.Request.URL)))
+			ctx.Out.Write(append(body, []byte("\n\n")...))
+		}
+
+		return nil
+	}
+}
+
+// bufferedConn is a connection whose reads drain the bytes already buffered by the reader first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffered reader, which reads from the connection once drained
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// oneConnListener is a listener that accepts a single connection, and blocks
+// any further Accept calls until it is closed
+type oneConnListener struct {
+	conn   net.Conn
+	mutex  sync.Mutex
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newOneConnListener creates a listener accepting the connection
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	return &oneConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+// Accept returns the connection on the first call, and blocks until the listener is closed afterwards
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mutex.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.closed
+
+	return nil, errors.New("listener closed")
+}
+
+// Close the listener, unblocking the Accept calls
+func (l *oneConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the local address of the connection
+func (l *oneConnListener) Addr() net.Addr {
+	return localAddr{}
+}
+
+// localAddr is a placeholder address of the one connection listener
+type localAddr struct{}
+
+func (localAddr) Network() string { return "tcp" }
+func (localAddr) String() string  { return "intercepted" }
@@ -26,25 +26,46 @@ type requestModel struct {
 	Proto      string      `json:"proto,omitempty"`
 	Header     http.Header `json:"header,omitempty"`
 	//Body io.ReadCloser
-	ContentLength    int64    `json:"content_length,omitempty"`
-	TransferEncoding []string `json:"transfer_encoding,omitempty"`
-	Body             string   `json:"body,omitempty"`
+	ContentLength    int64              `json:"content_length,omitempty"`
+	TransferEncoding []string           `json:"transfer_encoding,omitempty"`
+	Body             string             `json:"body,omitempty"`
+	GRPC             *grpcCallModel     `json:"grpc,omitempty"`
+	TLS              *tlsModel          `json:"tls,omitempty"`
+	ClientCerts      []certificateModel `json:"clientCertificates,omitempty"`
+	ValidationErrors []string           `json:"validationErrors,omitempty"`
 }
 
+// EncodeAsJSON encodes the HTTP request as a compact or indented JSON document
 func EncodeAsJSON(r *http.Request, prettyPrint bool) ([]byte, error) {
+	model := newRequestModel(r)
+
+	if prettyPrint {
+		return json.MarshalIndent(model, "", "    ")
+	}
+
+	return json.Marshal(model)
+}
+
+// newRequestModel captures the loggable attributes of the HTTP request
+func newRequestModel(r *http.Request) requestModel {
 	model := requestModel{
 		RemoteAddr: r.RemoteAddr, Host: r.Host, Method: r.Method,
 		URL: r.RequestURI, Proto: r.Proto, Header: r.Header,
 		ContentLength: r.ContentLength, TransferEncoding: r.TransferEncoding,
+		ValidationErrors: validationErrorsOf(r),
 	}
 
-	if r.Body != nil {
-		model.Body = string(copyRequestBody(r))
+	if r.TLS != nil {
+		model.TLS = newTLSModel(r)
+		model.ClientCerts = newCertificateModels(r.TLS.PeerCertificates)
 	}
 
-	if prettyPrint {
-		return json.MarshalIndent(model, "", "    ")
+	// gRPC bodies are binary, and possibly streamed: log the call instead
+	if isGRPCRequest(r) {
+		model.GRPC = decodeGRPCCall(r)
+	} else if r.Body != nil {
+		model.Body = string(copyRequestBody(r))
 	}
 
-	return json.Marshal(model)
+	return model
 }
@@ -0,0 +1,50 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// requestKey returns the value of the request key of the kind, e.g. the client IP address,
+// that the request is tracked against
+func requestKey(kind string, r *http.Request) string {
+	switch {
+	case kind == context.RequestKeyIP:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	case kind == context.RequestKeyPath:
+		return r.URL.Path
+	case kind == context.RequestKeyAPIKey:
+		if apiKey := r.Header.Get("X-Api-Key"); len(apiKey) > 0 {
+			return apiKey
+		}
+		if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+			return auth
+		}
+		return r.URL.Query().Get("api_key")
+	case kind == context.RequestKeyIdempotency:
+		return r.Header.Get("Idempotency-Key")
+	case strings.HasPrefix(kind, context.RequestKeyHeader):
+		return r.Header.Get(strings.TrimPrefix(kind, context.RequestKeyHeader))
+	}
+
+	return context.RequestKeyGlobal
+}
@@ -0,0 +1,261 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/openapi"
+)
+
+// MockHandler returns a handler function that routes the requests by the paths and
+// methods of the OpenAPI specification in the context, and replies with the example,
+// or schema-generated, response of the operation. The Prefer: code=<status> request
+// header selects one of the declared responses
+func MockHandler(ctx *context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failureSimulated(ctx, r) {
+			writeMockResponse(ctx.OpenAPI, w, r)
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// writeMockResponse writes the mock response of the operation matching the request
+func writeMockResponse(doc *openapi.Document, w http.ResponseWriter, r *http.Request) {
+	route := doc.Match(r.Method, r.URL.Path)
+
+	if route == nil {
+		http.Error(w, fmt.Sprintf("No path of the OpenAPI specification matches %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	if route.Operation == nil {
+		var methods []string
+
+		for method := range route.PathItem.Operations() {
+			methods = append(methods, method)
+		}
+
+		sort.Strings(methods)
+
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, fmt.Sprintf("%s is not declared for %s", r.Method, route.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	code, resp := selectMockResponse(route.Operation, preferredCode(r))
+
+	if resp == nil {
+		http.Error(w, fmt.Sprintf("No response is declared for %s %s", r.Method, route.Path), http.StatusNotImplemented)
+		return
+	}
+
+	contentType, media := selectMockContent(resp, r.Header.Get("Accept"))
+
+	if media == nil {
+		w.WriteHeader(code)
+		return
+	}
+
+	body, err := encodeMockBody(doc.Example(media), contentType)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// preferredCode returns the status code requested with the Prefer: code=<status> header, or 0
+func preferredCode(r *http.Request) int {
+	for _, preference := range strings.Split(r.Header.Get("Prefer"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(preference), "=")
+
+		if name == "code" {
+			code, _ := strconv.Atoi(value)
+			return code
+		}
+	}
+
+	return 0
+}
+
+// selectMockResponse returns the preferred response, if declared, or the success
+// response with the lowest status code. The response ranges, e.g. 2XX, are only
+// considered when no explicit status code is declared, falling back to the default
+// response, which is never selected by the preferred code
+func selectMockResponse(op *openapi.Operation, preferred int) (int, *openapi.Response) {
+	var codes, ranges []int
+
+	// The range keys by status code class
+	rangeKeys := make(map[int]string)
+
+	for key := range op.Responses {
+		if code, err := strconv.Atoi(key); err == nil {
+			codes = append(codes, code)
+		} else if class := responseClass(key); class > 0 {
+			ranges = append(ranges, class)
+			rangeKeys[class] = key
+		}
+	}
+
+	if preferred > 0 {
+		if resp, ok := op.Responses[strconv.Itoa(preferred)]; ok {
+			return preferred, resp
+		}
+
+		for _, class := range ranges {
+			if class == preferred/100 {
+				return preferred, op.Responses[rangeKeys[class]]
+			}
+		}
+	}
+
+	if len(codes) > 0 {
+		best := codes[0]
+
+		for _, code := range codes[1:] {
+			if betterMockCode(code, best) {
+				best = code
+			}
+		}
+
+		return best, op.Responses[strconv.Itoa(best)]
+	}
+
+	if len(ranges) > 0 {
+		best := ranges[0]
+
+		for _, class := range ranges[1:] {
+			if betterMockCode(class*100, best*100) {
+				best = class
+			}
+		}
+
+		return best * 100, op.Responses[rangeKeys[best]]
+	}
+
+	if resp, ok := op.Responses["default"]; ok {
+		return http.StatusOK, resp
+	}
+
+	return 0, nil
+}
+
+// betterMockCode reports whether the status code is a better default mock response
+// than the other: success codes first, then the lowest codes
+func betterMockCode(code, than int) bool {
+	if success := code/100 == 2; success != (than/100 == 2) {
+		return success
+	}
+
+	return code < than
+}
+
+// responseClass returns the status code class of the response range key, e.g. 4 for 4XX,
+// or 0 if the key is not a range
+func responseClass(key string) int {
+	if len(key) == 3 && strings.HasSuffix(strings.ToUpper(key), "XX") {
+		if class, err := strconv.Atoi(key[:1]); err == nil && class >= 1 && class <= 5 {
+			return class
+		}
+	}
+
+	return 0
+}
+
+// selectMockContent returns the content type of the response that best matches the
+// Accept header, preferring JSON when the client accepts anything
+func selectMockContent(resp *openapi.Response, accept string) (string, *openapi.MediaType) {
+	if len(resp.Content) == 0 {
+		return "", nil
+	}
+
+	contentTypes := make([]string, 0, len(resp.Content))
+
+	for contentType := range resp.Content {
+		contentTypes = append(contentTypes, contentType)
+	}
+
+	sort.Slice(contentTypes, func(i, j int) bool {
+		if isJSON(contentTypes[i]) != isJSON(contentTypes[j]) {
+			return isJSON(contentTypes[i])
+		}
+		return contentTypes[i] < contentTypes[j]
+	})
+
+	if len(accept) > 0 {
+		for _, accepted := range strings.Split(accept, ",") {
+			mediaRange, _, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+
+			for _, contentType := range contentTypes {
+				if mediaTypeMatches(mediaRange, contentType) {
+					return contentType, resp.Content[contentType]
+				}
+			}
+		}
+	}
+
+	return contentTypes[0], resp.Content[contentTypes[0]]
+}
+
+// mediaTypeMatches reports whether the content type matches the media range, e.g. text/*
+func mediaTypeMatches(mediaRange, contentType string) bool {
+	if mediaRange == "*/*" || mediaRange == contentType {
+		return true
+	}
+
+	if prefix := strings.TrimSuffix(mediaRange, "*"); prefix != mediaRange {
+		return strings.HasPrefix(contentType, prefix)
+	}
+
+	return false
+}
+
+// isJSON reports whether the content type is JSON, e.g. application/json or application/problem+json
+func isJSON(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// encodeMockBody encodes the example value in the content type: JSON for the JSON
+// content types and structured values, and the text of the value otherwise
+func encodeMockBody(value interface{}, contentType string) ([]byte, error) {
+	if !isJSON(contentType) {
+		switch v := value.(type) {
+		case map[string]interface{}, []interface{}:
+		case nil:
+			return nil, nil
+		case string:
+			return []byte(v), nil
+		default:
+			return []byte(fmt.Sprint(v)), nil
+		}
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,171 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// Request headers overriding the behavior of httpr for a single request
+const (
+	OverrideStatusHeader = "X-Httpr-Status"
+	OverrideDelayHeader  = "X-Httpr-Delay"
+	OverrideFailHeader   = "X-Httpr-Fail"
+	OverrideBodyHeader   = "X-Httpr-Body"
+)
+
+// maxOverrideDelay is the longest delay, in milliseconds, a request can ask for, so that
+// a single request can't hold a handler for hours
+const maxOverrideDelay = 60 * 1000
+
+// requestOverrides describes the behavior requested by the headers of a single request
+type requestOverrides struct {
+	status   int
+	delay    int
+	hasDelay bool
+	fail     *context.FailureStep
+	body     string
+	hasBody  bool
+}
+
+// overridesKey is the request context key of the request overrides
+type overridesKey struct{}
+
+// OverrideHandler returns a handler function that reads the X-Httpr-* request headers,
+// overriding the response code, the delay, the failure simulation and the response body
+// for that request only. Requests with invalid override headers are rejected, as are the
+// response code and body overrides when the responses are delegated, e.g. to the upstream
+func OverrideHandler(ctx *context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o, err := parseOverrides(ctx, r)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if o != nil {
+			r = r.WithContext(stdcontext.WithValue(r.Context(), overridesKey{}, o))
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// overridesOf returns the overrides requested by the request headers, or nil if there are none
+func overridesOf(r *http.Request) *requestOverrides {
+	o, _ := r.Context().Value(overridesKey{}).(*requestOverrides)
+	return o
+}
+
+// parseOverrides parses the override request headers. It returns nil if there are none
+func parseOverrides(ctx *context.Context, r *http.Request) (*requestOverrides, error) {
+	var o requestOverrides
+	var found bool
+
+	if v := r.Header.Get(OverrideStatusHeader); len(v) > 0 {
+		status, err := strconv.Atoi(v)
+
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid %s header: %q", OverrideStatusHeader, v)
+		}
+
+		if ctx.ResponseDelegated() {
+			return nil, fmt.Errorf("the %s header is not supported in this mode", OverrideStatusHeader)
+		}
+
+		o.status, found = status, true
+	}
+
+	if v := r.Header.Get(OverrideDelayHeader); len(v) > 0 {
+		delay, err := strconv.Atoi(v)
+
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("invalid %s header: %q", OverrideDelayHeader, v)
+		}
+
+		if delay > maxOverrideDelay {
+			return nil, fmt.Errorf("the %s header exceeds the maximum delay of %d ms", OverrideDelayHeader, maxOverrideDelay)
+		}
+
+		o.delay, o.hasDelay, found = delay, true, true
+	}
+
+	if v := r.Header.Get(OverrideFailHeader); len(v) > 0 {
+		var step context.FailureStep
+
+		switch v {
+		case "true":
+			step = context.FailureStep{Action: context.FailureActionStatus, StatusCode: ctx.FailureMode.FailureCode}
+		case "false":
+			step = context.FailureStep{Action: context.FailureActionStatus, StatusCode: ctx.HttpCode}
+
+			// Never report a failure, even if the configured response code is an error
+			if step.Failure() {
+				step.StatusCode = http.StatusOK
+			}
+		default:
+			// A single failure sequence step, e.g. 503, reset or 429(retry-after=2)
+			seq, err := context.ParseFailureSequence(v)
+
+			if err != nil || len(seq) != 1 {
+				return nil, fmt.Errorf("invalid %s header: %q", OverrideFailHeader, v)
+			}
+
+			step = seq[0]
+
+			if step.Delay > maxOverrideDelay {
+				return nil, fmt.Errorf("the %s header exceeds the maximum delay of %d ms", OverrideFailHeader, maxOverrideDelay)
+			}
+		}
+
+		o.fail, found = &step, true
+	}
+
+	if v, ok := r.Header[OverrideBodyHeader]; ok && len(v) > 0 {
+		if ctx.ResponseDelegated() {
+			return nil, fmt.Errorf("the %s header is not supported in this mode", OverrideBodyHeader)
+		}
+
+		o.body, o.hasBody, found = v[0], true, true
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return &o, nil
+}
+
+// stripOverrideHeaders removes the X-Httpr-* headers from the request forwarded to the
+// upstream service, unless the overrides are disabled and the headers are not httpr's
+func stripOverrideHeaders(ctx *context.Context, header http.Header) {
+	if ctx.DisableOverrides {
+		return
+	}
+
+	for name := range header {
+		if strings.HasPrefix(name, "X-Httpr-") {
+			header.Del(name)
+		}
+	}
+}
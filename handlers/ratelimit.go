@@ -0,0 +1,68 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// grpcResourceExhausted is the gRPC status code reported to rate limited gRPC clients
+const grpcResourceExhausted = 8
+
+// RateLimitHandler returns a handler function that simulates rate limiting: every response
+// carries the RateLimit-* headers, and requests over the limit are rejected with a
+// 429 Too Many Requests response and a Retry-After header, without calling the next handler
+func RateLimitHandler(ctx *context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(ctx.RateLimit.Key, r)
+		d := ctx.CheckRateLimit(key, time.Now())
+
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.Limit, ctx.RateLimit.Window))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+
+		if !d.Allowed {
+			retryAfter := ceilSeconds(d.RetryAfter)
+
+			ctx.Out.Write([]byte(fmt.Sprintf("Rate limit exceeded for %s %s (key %q): retry after %ds\n",
+				r.Method, r.URL, key, retryAfter)))
+
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+			if isGRPCRequest(r) {
+				writeGRPCStatus(w, grpcResourceExhausted, "rate limit exceeded")
+			} else {
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+
+			return
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// ceilSeconds rounds the duration up to whole seconds, as used in the rate limit headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
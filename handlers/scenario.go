@@ -0,0 +1,239 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+	"github.com/netbucket/httpr/openapi"
+)
+
+// ScenarioAdminPrefix is the path prefix of the endpoints inspecting and resetting the scenarios
+const ScenarioAdminPrefix = "/__httpr/scenarios"
+
+// scenarioModel is the model of the scenario response body templates
+type scenarioModel struct {
+	templateModel
+	Params    map[string]string
+	Scenario  string
+	State     string
+	NextState string
+}
+
+// ScenarioHandler returns a handler function that replies with the response of the first
+// scenario rule matching the request in the current state of its scenario, and transitions
+// the scenario to the next state of the rule. The requests no rule matches are passed
+// to the next handler, or rejected with a 404 error if there is none
+func ScenarioHandler(ctx *context.Context, h http.Handler) http.Handler {
+	templates := make(map[*context.ScenarioRule]*template.Template)
+
+	for _, s := range ctx.Scenarios {
+		for _, rule := range s.Rules {
+			tmpl, err := NewResponseTemplate(rule.Response.Body, "")
+
+			if err != nil {
+				log.Fatalf("Invalid response body of the scenario %s: %v", s.Name, err)
+			}
+
+			templates[rule] = tmpl
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failureSimulated(ctx, r) {
+			if h != nil {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		var body []byte
+
+		if r.Body != nil {
+			body = copyRequestBody(r)
+		}
+
+		var params map[string]string
+
+		s, rule, state := ctx.ApplyScenarioRule(func(rule *context.ScenarioRule) bool {
+			p, ok := matchScenarioRequest(&rule.Request, r, body)
+
+			if ok {
+				params = p
+			}
+
+			return ok
+		})
+
+		if rule == nil {
+			if h != nil {
+				h.ServeHTTP(w, r)
+			} else {
+				http.Error(w, fmt.Sprintf("No scenario rule matches %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+			}
+			return
+		}
+
+		next := state
+
+		if len(rule.NextState) > 0 {
+			next = rule.NextState
+		}
+
+		if next != state {
+			ctx.Out.Write([]byte(fmt.Sprintf("Scenario %s: %s -> %s\n", s.Name, state, next)))
+		}
+
+		var out []byte
+
+		if tmpl := templates[rule]; tmpl != nil {
+			model := scenarioModel{templateModel: newTemplateModel(r), Params: params, Scenario: s.Name, State: state, NextState: next}
+
+			var buf bytes.Buffer
+
+			if err := tmpl.Execute(&buf, model); err != nil {
+				log.Printf("Error rendering the response of the scenario %s: %v", s.Name, err)
+			}
+
+			out = buf.Bytes()
+		}
+
+		time.Sleep(time.Duration(rule.Response.Delay) * time.Millisecond)
+
+		for name, value := range rule.Response.Headers {
+			w.Header().Set(name, value)
+		}
+
+		w.WriteHeader(rule.Response.Status)
+		w.Write(out)
+	})
+}
+
+// matchScenarioRequest determines if the request matches the rule request, and returns
+// the path parameters of the match
+func matchScenarioRequest(req *context.ScenarioRequest, r *http.Request, body []byte) (map[string]string, bool) {
+	if len(req.Method) > 0 && !strings.EqualFold(req.Method, r.Method) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+
+	if len(req.Path) > 0 {
+		p, ok := openapi.MatchPath(req.Path, r.URL.Path)
+
+		if !ok {
+			return nil, false
+		}
+
+		params = p
+	}
+
+	query := r.URL.Query()
+
+	for name, value := range req.Query {
+		if query.Get(name) != value {
+			return nil, false
+		}
+	}
+
+	for name, value := range req.Headers {
+		if r.Header.Get(name) != value {
+			return nil, false
+		}
+	}
+
+	if len(req.BodyContains) > 0 && !bytes.Contains(body, []byte(req.BodyContains)) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// ScenarioAdminHandler returns a handler function that serves the endpoints listing the
+// scenarios and their states, setting the state of a scenario, and resetting the scenarios
+// to their initial state. The other requests are passed to the next handler
+func ScenarioAdminHandler(ctx *context.Context, h http.Handler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+ScenarioAdminPrefix, func(w http.ResponseWriter, r *http.Request) {
+		writeBinJSON(w, http.StatusOK, ctx.ScenarioStates())
+	})
+
+	mux.HandleFunc("POST "+ScenarioAdminPrefix+"/reset", func(w http.ResponseWriter, r *http.Request) {
+		ctx.ResetScenarios("")
+		writeBinJSON(w, http.StatusOK, ctx.ScenarioStates())
+	})
+
+	mux.HandleFunc("GET "+ScenarioAdminPrefix+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		writeScenarioState(ctx, w, r.PathValue("name"))
+	})
+
+	mux.HandleFunc("PUT "+ScenarioAdminPrefix+"/{name}/state", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			State string `json:"state"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.State) == 0 {
+			http.Error(w, `Expected a JSON body with the state, e.g. {"state": "Started"}`, http.StatusBadRequest)
+			return
+		}
+
+		if err := ctx.SetScenarioState(r.PathValue("name"), body.State); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		writeScenarioState(ctx, w, r.PathValue("name"))
+	})
+
+	mux.HandleFunc("POST "+ScenarioAdminPrefix+"/{name}/reset", func(w http.ResponseWriter, r *http.Request) {
+		if err := ctx.ResetScenarios(r.PathValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		writeScenarioState(ctx, w, r.PathValue("name"))
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == ScenarioAdminPrefix || strings.HasPrefix(r.URL.Path, ScenarioAdminPrefix+"/") {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// writeScenarioState writes the named scenario and its state as a JSON response
+func writeScenarioState(ctx *context.Context, w http.ResponseWriter, name string) {
+	for _, s := range ctx.ScenarioStates() {
+		if s.Name == name {
+			writeBinJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("unknown scenario: %s", name), http.StatusNotFound)
+}
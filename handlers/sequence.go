@@ -0,0 +1,72 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// simulateFailureStep applies the delay and the Retry-After header of the failure sequence step,
+// and simulates timeouts and connection resets. It returns false if the request was
+// consumed by the step, and must not be handled any further
+func simulateFailureStep(ctx *context.Context, w http.ResponseWriter, r *http.Request, step context.FailureStep) bool {
+	if step.Delay > 0 {
+		time.Sleep(time.Duration(step.Delay) * time.Millisecond)
+	}
+
+	if step.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(step.RetryAfter))
+	}
+
+	switch step.Action {
+	case context.FailureActionTimeout:
+		ctx.Out.Write([]byte(fmt.Sprintf("Simulating a timeout for %s %s\n", r.Method, r.URL)))
+
+		// Never reply: wait for the client to give up
+		<-r.Context().Done()
+
+		return false
+	case context.FailureActionReset:
+		ctx.Out.Write([]byte(fmt.Sprintf("Simulating a connection reset for %s %s\n", r.Method, r.URL)))
+
+		resetConnection(w)
+
+		return false
+	}
+
+	return true
+}
+
+// resetConnection abruptly closes the connection of the request, sending a TCP RST
+// when possible. HTTP/2 connections can't be hijacked: the stream is reset instead
+func resetConnection(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+
+			resetConn(conn)
+			return
+		}
+	}
+
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,133 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// Streaming modes supported by the StreamHandler
+const (
+	StreamSSE     = "sse"
+	StreamChunked = "chunked"
+)
+
+// streamEventModel is the data made available to the stream data template
+type streamEventModel struct {
+	ID    int
+	Count int
+}
+
+// StreamHandler returns a handler function that streams a sequence of
+// Server-Sent Events or chunks back to the HTTP client at the configured
+// interval, flushing each one as it is written
+func StreamHandler(ctx *context.Context, h http.Handler) http.Handler {
+	tmpl, err := template.New("stream").Funcs(templateFuncs).Parse(ctx.Stream.Data)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failureSimulated(ctx, r) {
+			streamEvents(ctx, tmpl, w, r)
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// streamEvents writes the events, resuming after the Last-Event-ID if the
+// client sent one, and aborts the connection if a disconnect is configured
+func streamEvents(ctx *context.Context, tmpl *template.Template, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		log.Print("Streaming is not supported by the response writer")
+		return
+	}
+
+	first := 1
+
+	if ctx.Stream.Mode == StreamSSE {
+		if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+			first = lastID + 1
+		}
+	}
+
+	flusher.Flush()
+
+	for id, sent := first, 0; ctx.Stream.Count == 0 || id <= ctx.Stream.Count; id, sent = id+1, sent+1 {
+		if ctx.Stream.DisconnectAfter > 0 && sent == ctx.Stream.DisconnectAfter {
+			// Abort the response without terminating the stream properly
+			panic(http.ErrAbortHandler)
+		}
+
+		if id > first && ctx.Stream.Interval > 0 {
+			select {
+			case <-time.After(time.Duration(ctx.Stream.Interval) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		var data bytes.Buffer
+
+		if err := tmpl.Execute(&data, streamEventModel{ID: id, Count: ctx.Stream.Count}); err != nil {
+			log.Printf("Error rendering stream data: %v", err)
+			return
+		}
+
+		if _, err := w.Write(formatStreamEvent(ctx, id, data.String())); err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// formatStreamEvent encodes the event data as a Server-Sent Event, or as a
+// newline-terminated chunk in the chunked mode
+func formatStreamEvent(ctx *context.Context, id int, data string) []byte {
+	if ctx.Stream.Mode != StreamSSE {
+		return []byte(data + "\n")
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "id: %d\n", id)
+
+	if len(ctx.Stream.EventName) > 0 {
+		fmt.Fprintf(&buf, "event: %s\n", ctx.Stream.EventName)
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
@@ -0,0 +1,154 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// tcpBufferSize is the maximum size of a chunk of data relayed by the TCP proxy
+const tcpBufferSize = 32 * 1024
+
+// TCPProxyHandler returns a connection handler that relays the bytes between the client
+// and the upstream, applying the latency, bandwidth limit, resets and half-open connections
+// configured in the context, and logs the byte counts when the connection is closed
+func TCPProxyHandler(ctx *context.Context) func(conn net.Conn) {
+	return func(client net.Conn) {
+		defer client.Close()
+
+		source := client.RemoteAddr().String()
+		start := time.Now()
+
+		if chance(ctx.TCPProxy.HalfOpenProbability) {
+			// Never reply nor close the connection: the client sees a peer that silently went away
+			ctx.Out.Write([]byte(fmt.Sprintf("TCP connection from %s: half-open\n", source)))
+
+			discarded, _ := io.Copy(io.Discard, client)
+
+			ctx.Out.Write([]byte(fmt.Sprintf("TCP connection from %s closed after %v: %d bytes discarded\n",
+				source, time.Since(start).Round(time.Millisecond), discarded)))
+			return
+		}
+
+		upstream, err := net.DialTimeout("tcp", ctx.TCPProxy.Upstream, tunnelDialTimeout)
+
+		if err != nil {
+			log.Printf("Error connecting to %s: %v", ctx.TCPProxy.Upstream, err)
+			return
+		}
+
+		defer upstream.Close()
+
+		ctx.Out.Write([]byte(fmt.Sprintf("TCP connection from %s to %s opened\n", source, ctx.TCPProxy.Upstream)))
+
+		var sent, received int64
+		var reset int32
+		var wg sync.WaitGroup
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			sent = relayTCP(ctx, upstream, client, &reset)
+		}()
+
+		go func() {
+			defer wg.Done()
+			received = relayTCP(ctx, client, upstream, &reset)
+		}()
+
+		wg.Wait()
+
+		outcome := "closed"
+
+		if atomic.LoadInt32(&reset) != 0 {
+			outcome = "reset"
+		}
+
+		ctx.Out.Write([]byte(fmt.Sprintf("TCP connection from %s to %s %s after %v: %d bytes sent, %d bytes received\n",
+			source, ctx.TCPProxy.Upstream, outcome, time.Since(start).Round(time.Millisecond), sent, received)))
+	}
+}
+
+// relayTCP copies the bytes from src to dst, delaying and throttling every chunk of data,
+// and returns the number of bytes copied. When a reset is simulated, both connections
+// are reset, and the reset flag is set
+func relayTCP(ctx *context.Context, dst net.Conn, src net.Conn, reset *int32) int64 {
+	size := tcpBufferSize
+
+	// Keep the chunks small enough to pace the throughput smoothly
+	if ctx.TCPProxy.Bandwidth > 0 && ctx.TCPProxy.Bandwidth < size {
+		size = ctx.TCPProxy.Bandwidth
+	}
+
+	buf := make([]byte, size)
+
+	var copied int64
+
+	for {
+		n, err := src.Read(buf)
+
+		if n > 0 {
+			if ctx.Delay > 0 {
+				time.Sleep(time.Duration(ctx.Delay) * time.Millisecond)
+			}
+
+			if chance(ctx.TCPProxy.ResetProbability) {
+				atomic.StoreInt32(reset, 1)
+				resetConn(src)
+				resetConn(dst)
+				return copied
+			}
+
+			written, werr := dst.Write(buf[:n])
+			copied += int64(written)
+
+			if werr != nil {
+				return copied
+			}
+
+			if ctx.TCPProxy.Bandwidth > 0 {
+				time.Sleep(time.Duration(n) * time.Second / time.Duration(ctx.TCPProxy.Bandwidth))
+			}
+		}
+
+		if err != nil {
+			closeWrite(dst)
+			return copied
+		}
+	}
+}
+
+// resetConn closes the connection, sending a TCP RST instead of a FIN when supported
+func resetConn(conn net.Conn) {
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.SetLinger(0)
+	}
+
+	conn.Close()
+}
+
+// chance returns true with the probability p
+func chance(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
@@ -0,0 +1,212 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// templateModel is the data made available to the response templates.
+// It exposes the logged request attributes along with the parsed
+// JSON body, query parameters and the request path segments
+type templateModel struct {
+	requestModel
+	JSON       interface{}
+	Query      url.Values
+	Path       string
+	PathParams []string
+}
+
+// templateFuncs are the helper functions available to the response templates
+var templateFuncs = template.FuncMap{
+	"uuid":       newUUID,
+	"now":        time.Now,
+	"timestamp":  timestamp,
+	"unixMillis": func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+	"randInt":    randInt,
+	"randHex":    randHex,
+	"randString": randString,
+	"toJSON":     toJSON,
+	"header":     func(h http.Header, name string) string { return h.Get(name) },
+}
+
+// ResponseTemplateHandler returns a handler function that renders the
+// response template, if one is configured, and writes the result back
+// to the HTTP client. The X-Httpr-Body request header overrides the template
+func ResponseTemplateHandler(ctx *context.Context, h http.Handler) http.Handler {
+	tmpl, err := NewResponseTemplate(ctx.ResponseBody, ctx.ResponseTemplateFile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o := overridesOf(r); o != nil && o.hasBody {
+			if !failureSimulated(ctx, r) {
+				io.WriteString(w, o.body)
+			}
+		} else if tmpl != nil && !failureSimulated(ctx, r) {
+			body, err := RenderResponseTemplate(tmpl, r)
+
+			if err != nil {
+				log.Printf("Error rendering response template: %v", err)
+			} else {
+				w.Write(body)
+			}
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// NewResponseTemplate parses the inline response body template, or the
+// template file if the inline body is blank. A nil template is returned
+// if neither is specified
+func NewResponseTemplate(body, fileName string) (*template.Template, error) {
+	if len(body) == 0 && len(fileName) > 0 {
+		data, err := ioutil.ReadFile(fileName)
+
+		if err != nil {
+			return nil, err
+		}
+
+		body = string(data)
+	}
+
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	return template.New("response").Funcs(templateFuncs).Parse(body)
+}
+
+// RenderResponseTemplate executes the response template against the HTTP request
+func RenderResponseTemplate(tmpl *template.Template, r *http.Request) ([]byte, error) {
+	model := newTemplateModel(r)
+
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, model); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// newTemplateModel captures the attributes of the HTTP request available to the templates
+func newTemplateModel(r *http.Request) templateModel {
+	model := templateModel{
+		requestModel: newRequestModel(r),
+		Query:        r.URL.Query(),
+		Path:         r.URL.Path,
+	}
+
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if len(segment) > 0 {
+			model.PathParams = append(model.PathParams, segment)
+		}
+	}
+
+	if len(model.Body) > 0 {
+		// Not every request body is JSON: leave the parsed body empty if it isn't
+		json.Unmarshal([]byte(model.Body), &model.JSON)
+	}
+
+	return model
+}
+
+// newUUID generates a random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// timestamp formats the current time using the optional Go time layout,
+// or RFC 3339 if the layout is omitted
+func timestamp(layout ...string) string {
+	if len(layout) > 0 {
+		return time.Now().Format(layout[0])
+	}
+
+	return time.Now().Format(time.RFC3339)
+}
+
+// randInt returns a random integer in the [min, max) range
+func randInt(min, max int) int {
+	if max <= min {
+		return min
+	}
+
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(max-min)))
+
+	return min + int(n.Int64())
+}
+
+// randHex returns a random hex string encoding n bytes
+func randHex(n int) (string, error) {
+	if n < 0 {
+		return "", fmt.Errorf("randHex: invalid length %d", n)
+	}
+
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b), nil
+}
+
+// randString returns a random alphanumeric string of length n
+func randString(n int) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	if n < 0 {
+		return "", fmt.Errorf("randString: invalid length %d", n)
+	}
+
+	b := make([]byte, n)
+
+	for i := range b {
+		b[i] = letters[randInt(0, len(letters))]
+	}
+
+	return string(b), nil
+}
+
+// toJSON encodes the value as a JSON string
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+
+	return string(data), err
+}
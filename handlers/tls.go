@@ -0,0 +1,116 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// tlsModel is the loggable representation of the TLS session a request was received on
+type tlsModel struct {
+	Version           string `json:"version"`
+	CipherSuite       string `json:"cipherSuite"`
+	ALPN              string `json:"alpn,omitempty"`
+	ServerName        string `json:"serverName,omitempty"`
+	Resumed           bool   `json:"resumed"`
+	HandshakeDuration string `json:"handshakeDuration,omitempty"`
+}
+
+// newTLSModel captures the negotiated TLS session parameters of the HTTP request
+func newTLSModel(r *http.Request) *tlsModel {
+	if r.TLS == nil {
+		return nil
+	}
+
+	model := &tlsModel{
+		Version:     tls.VersionName(r.TLS.Version),
+		CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+		ALPN:        r.TLS.NegotiatedProtocol,
+		ServerName:  r.TLS.ServerName,
+		Resumed:     r.TLS.DidResume,
+	}
+
+	if d, ok := context.HandshakeDuration(r); ok {
+		model.HandshakeDuration = d.String()
+	}
+
+	return model
+}
+
+// formatTLS formats the TLS session parameters for the plain text log
+func formatTLS(model *tlsModel) []byte {
+	return []byte(fmt.Sprintf("TLS: version=%s cipher=%s alpn=%s sni=%s resumed=%t handshake=%s\n",
+		model.Version, model.CipherSuite, model.ALPN, model.ServerName, model.Resumed, model.HandshakeDuration))
+}
+
+// certificateModel is the loggable representation of an X.509 certificate
+type certificateModel struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	SANs      []string  `json:"sans,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// newCertificateModels captures the loggable attributes of the certificate chain
+func newCertificateModels(chain []*x509.Certificate) []certificateModel {
+	var models []certificateModel
+
+	for _, cert := range chain {
+		model := certificateModel{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			Serial:    fmt.Sprintf("%X", cert.SerialNumber),
+			SANs:      append([]string{}, cert.DNSNames...),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		}
+
+		for _, ip := range cert.IPAddresses {
+			model.SANs = append(model.SANs, ip.String())
+		}
+
+		model.SANs = append(model.SANs, cert.EmailAddresses...)
+
+		for _, uri := range cert.URIs {
+			model.SANs = append(model.SANs, uri.String())
+		}
+
+		models = append(models, model)
+	}
+
+	return models
+}
+
+// formatCertificates formats the certificate chain for the plain text log
+func formatCertificates(certs []certificateModel) []byte {
+	var buf bytes.Buffer
+
+	for i, cert := range certs {
+		fmt.Fprintf(&buf, "Client certificate %d: subject=%q issuer=%q serial=%s sans=[%s] valid=%s..%s\n",
+			i+1, cert.Subject, cert.Issuer, cert.Serial, strings.Join(cert.SANs, ", "),
+			cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return buf.Bytes()
+}
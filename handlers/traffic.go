@@ -0,0 +1,128 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/netbucket/httpr/openapi"
+)
+
+// ReadTraffic reads the requests and the responses logged in compact or pretty-printed
+// JSON format, and pairs each response with its request. The lines that are not part
+// of a JSON log entry are skipped
+func ReadTraffic(r io.Reader) ([]openapi.Exchange, error) {
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var exchanges []openapi.Exchange
+
+	for offset := 0; offset < len(data); {
+		entry, n := nextLogEntry(data[offset:])
+
+		if n == 0 {
+			break
+		}
+
+		offset += n
+
+		if entry == nil {
+			continue
+		}
+
+		var probe struct {
+			StatusCode *int `json:"statusCode"`
+		}
+
+		json.Unmarshal(entry, &probe)
+
+		if probe.StatusCode == nil {
+			var req requestModel
+
+			if err := json.Unmarshal(entry, &req); err == nil && len(req.Method) > 0 {
+				exchanges = append(exchanges, openapi.Exchange{
+					Method: req.Method, URL: requestURI(req.URL), RequestHeader: req.Header, RequestBody: req.Body,
+				})
+			}
+		} else {
+			var resp responseModel
+
+			if err := json.Unmarshal(entry, &resp); err == nil {
+				pairResponse(exchanges, resp)
+			}
+		}
+	}
+
+	return exchanges, nil
+}
+
+// nextLogEntry returns the JSON log entry starting the data, if any, and the number
+// of bytes consumed: the length of the entry, or of the skipped line
+func nextLogEntry(data []byte) (json.RawMessage, int) {
+	line := len(data)
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line = i + 1
+	}
+
+	if !bytes.HasPrefix(bytes.TrimLeft(data[:line], " \t\r"), []byte("{")) {
+		return nil, line
+	}
+
+	var entry json.RawMessage
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if err := dec.Decode(&entry); err != nil {
+		return nil, line
+	}
+
+	return entry, int(dec.InputOffset())
+}
+
+// pairResponse sets the response of the earliest unanswered request with the method
+// and the URL of the response. The upstream URL may carry an additional path prefix
+func pairResponse(exchanges []openapi.Exchange, resp responseModel) {
+	uri := requestURI(resp.URL)
+
+	for i := range exchanges {
+		exchange := &exchanges[i]
+
+		if exchange.StatusCode == 0 && (len(resp.Method) == 0 || exchange.Method == resp.Method) &&
+			strings.HasSuffix(uri, exchange.URL) {
+			exchange.StatusCode = resp.StatusCode
+			exchange.ResponseHeader = resp.Header
+			exchange.ResponseBody = resp.Body
+			return
+		}
+	}
+}
+
+// requestURI returns the path and the query of the logged URL, which is absolute
+// for the forward proxy requests and the upstream responses
+func requestURI(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.IsAbs() {
+		return u.RequestURI()
+	}
+
+	return rawURL
+}
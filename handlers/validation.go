@@ -0,0 +1,127 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// validationErrorsKey is the request context key of the request validation errors
+type validationErrorsKey struct{}
+
+// validationErrorModel is the model of the validation error body template
+type validationErrorModel struct {
+	Method string
+	Path   string
+	Errors []string
+}
+
+// ValidationHandler returns a handler function that validates the incoming requests against
+// the OpenAPI document and the JSON Schemas in the context. The validation errors annotate
+// the request log, and the invalid requests are rejected with a 400 error if configured
+func ValidationHandler(ctx *context.Context, h http.Handler) http.Handler {
+	tmpl, err := NewResponseTemplate(ctx.Validation.ErrorBody, "")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if errs := validateRequest(ctx, r); len(errs) > 0 {
+			r = r.WithContext(stdcontext.WithValue(r.Context(), validationErrorsKey{}, errs))
+
+			if ctx.Validation.Reject {
+				// The request is rejected: the next handlers only log it
+				r = r.WithContext(stdcontext.WithValue(r.Context(), failureOutcomeKey{}, true))
+
+				model := validationErrorModel{Method: r.Method, Path: r.URL.Path, Errors: errs}
+
+				var body []byte
+
+				if tmpl != nil {
+					var buf bytes.Buffer
+
+					if err := tmpl.Execute(&buf, model); err != nil {
+						log.Printf("Error rendering the validation error body: %v", err)
+					}
+
+					body = buf.Bytes()
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					body, _ = json.Marshal(map[string]interface{}{"error": "Request validation failed", "errors": errs})
+				}
+
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(body)
+			}
+		}
+
+		if h != nil {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// validateRequest validates the request, and returns the validation errors
+func validateRequest(ctx *context.Context, r *http.Request) []string {
+	doc := ctx.Validation.Document
+	route := doc.Match(r.Method, r.URL.Path)
+
+	if route == nil || route.Operation == nil {
+		if !ctx.Validation.Strict() {
+			return nil
+		}
+
+		if route == nil {
+			return []string{fmt.Sprintf("no path of the OpenAPI specification matches %s", r.URL.Path)}
+		}
+
+		return []string{fmt.Sprintf("%s is not declared for %s", r.Method, route.Path)}
+	}
+
+	var body []byte
+
+	// gRPC bodies are binary, and possibly streamed
+	if r.Body != nil && !isGRPCRequest(r) {
+		body = copyRequestBody(r)
+	}
+
+	return doc.ValidateRequest(route, r, body)
+}
+
+// validationErrorsOf returns the validation errors of the request
+func validationErrorsOf(r *http.Request) []string {
+	errs, _ := r.Context().Value(validationErrorsKey{}).([]string)
+	return errs
+}
+
+// formatValidationErrors formats the validation errors for the raw request log
+func formatValidationErrors(errs []string) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("Validation errors:\n")
+
+	for _, err := range errs {
+		buf.WriteString(fmt.Sprintf("  - %s\n", err))
+	}
+
+	return append(buf.Bytes(), '\n')
+}
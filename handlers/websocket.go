@@ -0,0 +1,702 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netbucket/httpr/context"
+)
+
+// WebSocket frame opcodes, as defined by RFC 6455
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// wsAcceptGUID is used to compute the Sec-WebSocket-Accept handshake header
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsPreviewLength is the maximum number of payload bytes included in the frame log
+const wsPreviewLength = 64
+
+// DefaultWebSocketMaxFrameSize is the default maximum payload length, in bytes, of the frames
+const DefaultWebSocketMaxFrameSize = 1 << 20
+
+// wsCloseMessageTooBig is the close code of the connections sending oversized frames
+const wsCloseMessageTooBig = 1009
+
+// wsFrameTooBigError is returned when the payload length of a frame exceeds the maximum frame size
+type wsFrameTooBigError struct {
+	length  uint64
+	maxSize int
+}
+
+func (e *wsFrameTooBigError) Error() string {
+	return fmt.Sprintf("frame of %d bytes exceeds the maximum frame size of %d bytes", e.length, e.maxSize)
+}
+
+// wsFrame is a single WebSocket frame, with the payload unmasked
+type wsFrame struct {
+	Fin     bool
+	Opcode  byte
+	Masked  bool
+	Mask    [4]byte
+	Payload []byte
+}
+
+// wsFrameModel is the loggable representation of a WebSocket frame
+type wsFrameModel struct {
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Direction  string `json:"direction"`
+	Opcode     string `json:"opcode"`
+	Fin        bool   `json:"fin"`
+	Length     int    `json:"length"`
+	Preview    string `json:"preview,omitempty"`
+}
+
+// WebSocketEchoHandler returns a handler function that accepts WebSocket
+// upgrade requests and echoes every data frame back to the client.
+// Requests that are not WebSocket upgrades are passed on to the next handler
+func WebSocketEchoHandler(ctx *context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			if h != nil {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		if !acceptWebSocketUpgrade(ctx, w, r) {
+			return
+		}
+
+		conn, brw, err := hijackWebSocket(w, r)
+
+		if err != nil {
+			log.Printf("Error accepting WebSocket connection: %v", err)
+			return
+		}
+
+		defer conn.Close()
+
+		echoWebSocketFrames(ctx, conn, brw.Reader, r.RemoteAddr)
+	})
+}
+
+// WebSocketProxyHandler returns a handler function that tunnels WebSocket
+// upgrade requests to the upstream service, logging every frame exchanged.
+// Requests that are not WebSocket upgrades are passed on to the next handler
+func WebSocketProxyHandler(ctx *context.Context, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			if h != nil {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		if !acceptWebSocketUpgrade(ctx, w, r) {
+			return
+		}
+
+		upstream, upstreamReader, resp, err := dialUpstreamWebSocket(ctx, r)
+
+		if err != nil {
+			log.Printf("Error connecting to the upstream WebSocket: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer upstream.Close()
+
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			// The upstream refused the upgrade: relay its response as is
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		hj, ok := w.(http.Hijacker)
+
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		conn, brw, err := hj.Hijack()
+
+		if err != nil {
+			log.Printf("Error accepting WebSocket connection: %v", err)
+			return
+		}
+
+		defer conn.Close()
+
+		if err := resp.Write(conn); err != nil {
+			log.Printf("Error relaying the WebSocket handshake: %v", err)
+			return
+		}
+
+		tunnelWebSocketFrames(ctx, conn, brw.Reader, upstream, upstreamReader, r.RemoteAddr)
+	})
+}
+
+// isWebSocketUpgrade determines if the HTTP request is a WebSocket upgrade request
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerContainsToken checks if the comma-separated header values contain the token
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptWebSocketUpgrade logs the upgrade request, and applies the delay and the failure
+// simulation to it, including the ones requested by the override headers. It returns false
+// if the upgrade must not proceed
+func acceptWebSocketUpgrade(ctx *context.Context, w http.ResponseWriter, r *http.Request) bool {
+	writeRequestLog(ctx, r)
+
+	// The upgrade was already rejected, e.g. by the validation
+	if failed, _ := r.Context().Value(failureOutcomeKey{}).(bool); failed {
+		return false
+	}
+
+	o := overridesOf(r)
+
+	if o != nil && o.hasDelay {
+		time.Sleep(time.Duration(o.delay) * time.Millisecond)
+	} else {
+		ctx.SimulateDelay()
+	}
+
+	if ctx.FailureSimulationEnabled() || (o != nil && o.fail != nil) {
+		statusCode, failed, proceed := simulateRequestFailure(ctx, w, r)
+
+		if !proceed {
+			return false
+		}
+
+		if failed {
+			w.WriteHeader(statusCode)
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeRequestLog logs the HTTP request in the format configured in the context
+func writeRequestLog(ctx *context.Context, r *http.Request) {
+	if ctx.LogJSON || ctx.LogPrettyJSON {
+		if body, err := EncodeAsJSON(r, ctx.LogPrettyJSON); err == nil {
+			ctx.Out.Write(append(body, []byte("\n")...))
+		}
+	} else if body, err := httputil.DumpRequest(r, false); err == nil {
+		ctx.Out.Write([]byte(fmt.Sprintf("Remote address: %s\n", r.RemoteAddr)))
+		ctx.Out.Write(append(body, []byte("\n")...))
+	}
+}
+
+// hijackWebSocket completes the server side of the WebSocket handshake
+// and takes over the underlying connection
+func hijackWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if len(key) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, errors.New("missing Sec-WebSocket-Key header")
+	}
+
+	hj, ok := w.(http.Hijacker)
+
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+
+	conn, brw, err := hj.Hijack()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, brw, nil
+}
+
+// webSocketAccept computes the Sec-WebSocket-Accept value for the client key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dialUpstreamWebSocket connects to the upstream service and forwards the upgrade request
+func dialUpstreamWebSocket(ctx *context.Context, r *http.Request) (net.Conn, *bufio.Reader, *http.Response, error) {
+	target := ctx.UpstreamURL
+
+	host := target.Host
+
+	if len(target.Port()) == 0 {
+		if target.Scheme == "https" || target.Scheme == "wss" {
+			host = net.JoinHostPort(target.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+
+	if target.Scheme == "https" || target.Scheme == "wss" {
+		var tlsConfig *tls.Config
+
+		if tlsConfig, err = ctx.NewUpstreamTLSConfig(); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if len(tlsConfig.ServerName) == 0 {
+			tlsConfig.ServerName = target.Hostname()
+		}
+
+		// The WebSocket upgrade is only defined for HTTP/1.1
+		tlsConfig.NextProtos = []string{"http/1.1"}
+
+		conn, err = tls.Dial("tcp", host, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	outReq := r.Clone(r.Context())
+	outReq.URL.Scheme = target.Scheme
+	outReq.URL.Host = target.Host
+	outReq.URL.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	outReq.Host = target.Host
+
+	stripOverrideHeaders(ctx, outReq.Header)
+
+	if err := outReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, outReq)
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	return conn, reader, resp, nil
+}
+
+// echoWebSocketFrames echoes the data frames received from the client until the
+// connection is closed, or the frame limit for an injected close is reached
+func echoWebSocketFrames(ctx *context.Context, conn net.Conn, reader *bufio.Reader, remoteAddr string) {
+	dataFrames := 0
+
+	for {
+		f, err := readWebSocketFrame(reader, maxFrameSize(ctx))
+
+		if err != nil {
+			rejectOversizedFrame(ctx, conn, remoteAddr, "server->client", false, err)
+			return
+		}
+
+		logWebSocketFrame(ctx, remoteAddr, "client->server", f)
+
+		switch f.Opcode {
+		case wsOpClose:
+			reply := &wsFrame{Fin: true, Opcode: wsOpClose, Payload: f.Payload}
+			logWebSocketFrame(ctx, remoteAddr, "server->client", reply)
+			writeWebSocketFrame(conn, reply)
+			return
+		case wsOpPing:
+			reply := &wsFrame{Fin: true, Opcode: wsOpPong, Payload: f.Payload}
+			logWebSocketFrame(ctx, remoteAddr, "server->client", reply)
+			writeWebSocketFrame(conn, reply)
+			continue
+		case wsOpPong:
+			continue
+		}
+
+		simulateFrameDelay(ctx)
+
+		reply := &wsFrame{Fin: f.Fin, Opcode: f.Opcode, Payload: f.Payload}
+		logWebSocketFrame(ctx, remoteAddr, "server->client", reply)
+
+		if err := writeWebSocketFrame(conn, reply); err != nil {
+			return
+		}
+
+		dataFrames++
+
+		if ctx.WebSocket.CloseAfter > 0 && dataFrames >= ctx.WebSocket.CloseAfter {
+			injectWebSocketClose(ctx, conn, remoteAddr)
+			return
+		}
+	}
+}
+
+// tunnelWebSocketFrames relays the frames between the client and the upstream
+// connections in both directions, until either side closes the connection
+func tunnelWebSocketFrames(ctx *context.Context, client net.Conn, clientReader *bufio.Reader,
+	upstream net.Conn, upstreamReader *bufio.Reader, remoteAddr string) {
+
+	var mutex sync.Mutex
+	var once sync.Once
+
+	dataFrames := 0
+	done := make(chan struct{})
+
+	finish := func() {
+		once.Do(func() { close(done) })
+	}
+
+	relay := func(src *bufio.Reader, srcConn, dst net.Conn, direction, reverse string, masked bool) {
+		defer finish()
+
+		for {
+			f, err := readWebSocketFrame(src, maxFrameSize(ctx))
+
+			if err != nil {
+				rejectOversizedFrame(ctx, srcConn, remoteAddr, reverse, masked, err)
+				return
+			}
+
+			logWebSocketFrame(ctx, remoteAddr, direction, f)
+
+			isData := f.Opcode == wsOpText || f.Opcode == wsOpBinary || f.Opcode == wsOpContinuation
+
+			if isData {
+				simulateFrameDelay(ctx)
+			}
+
+			if err := writeWebSocketFrame(dst, f); err != nil {
+				return
+			}
+
+			if f.Opcode == wsOpClose {
+				continue
+			}
+
+			if isData && ctx.WebSocket.CloseAfter > 0 {
+				mutex.Lock()
+				dataFrames++
+				limitReached := dataFrames == ctx.WebSocket.CloseAfter
+				mutex.Unlock()
+
+				if limitReached {
+					injectWebSocketClose(ctx, client, remoteAddr)
+					return
+				}
+			}
+		}
+	}
+
+	// The frames sent to the upstream are masked, as the client frames
+	go relay(clientReader, client, upstream, "client->upstream", "upstream->client", false)
+	go relay(upstreamReader, upstream, client, "upstream->client", "client->upstream", true)
+
+	<-done
+}
+
+// injectWebSocketClose terminates the client connection: with a close frame
+// carrying the configured close code, or abruptly if the close code is 0
+func injectWebSocketClose(ctx *context.Context, conn net.Conn, remoteAddr string) {
+	if ctx.WebSocket.CloseCode > 0 {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, uint16(ctx.WebSocket.CloseCode))
+
+		f := &wsFrame{Fin: true, Opcode: wsOpClose, Payload: payload}
+		logWebSocketFrame(ctx, remoteAddr, "server->client", f)
+		writeWebSocketFrame(conn, f)
+	} else {
+		ctx.Out.Write([]byte(fmt.Sprintf("WebSocket %s: connection closed abruptly\n", remoteAddr)))
+	}
+
+	conn.Close()
+}
+
+// rejectOversizedFrame closes the connection with the 1009 (message too big) close code,
+// if the frame could not be read because it exceeds the maximum frame size
+func rejectOversizedFrame(ctx *context.Context, conn net.Conn, remoteAddr, direction string, masked bool, err error) {
+	var tooBig *wsFrameTooBigError
+
+	if !errors.As(err, &tooBig) {
+		return
+	}
+
+	ctx.Out.Write([]byte(fmt.Sprintf("WebSocket %s: %v\n", remoteAddr, tooBig)))
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, wsCloseMessageTooBig)
+
+	f := &wsFrame{Fin: true, Opcode: wsOpClose, Masked: masked, Payload: payload}
+
+	if masked {
+		rand.Read(f.Mask[:])
+	}
+
+	logWebSocketFrame(ctx, remoteAddr, direction, f)
+	writeWebSocketFrame(conn, f)
+
+	conn.Close()
+}
+
+// maxFrameSize returns the maximum payload length of the frames
+func maxFrameSize(ctx *context.Context) int {
+	if ctx.WebSocket.MaxFrameSize > 0 {
+		return ctx.WebSocket.MaxFrameSize
+	}
+
+	return DefaultWebSocketMaxFrameSize
+}
+
+// simulateFrameDelay will introduce a timed delay before relaying a data frame, if specified
+func simulateFrameDelay(ctx *context.Context) {
+	if ctx.WebSocket.FrameDelay > 0 {
+		time.Sleep(time.Duration(ctx.WebSocket.FrameDelay) * time.Millisecond)
+	}
+}
+
+// logWebSocketFrame logs the frame direction, opcode and a payload preview
+func logWebSocketFrame(ctx *context.Context, remoteAddr, direction string, f *wsFrame) {
+	model := wsFrameModel{
+		RemoteAddr: remoteAddr,
+		Direction:  direction,
+		Opcode:     webSocketOpcodeName(f.Opcode),
+		Fin:        f.Fin,
+		Length:     len(f.Payload),
+		Preview:    webSocketPayloadPreview(f),
+	}
+
+	if ctx.LogJSON || ctx.LogPrettyJSON {
+		var body []byte
+		var err error
+
+		if ctx.LogPrettyJSON {
+			body, err = json.MarshalIndent(model, "", "    ")
+		} else {
+			body, err = json.Marshal(model)
+		}
+
+		if err == nil {
+			ctx.Out.Write(append(body, []byte("\n")...))
+		}
+		return
+	}
+
+	ctx.Out.Write([]byte(fmt.Sprintf("WebSocket %s %s: opcode=%s fin=%t length=%d payload=%s\n",
+		model.RemoteAddr, model.Direction, model.Opcode, model.Fin, model.Length, model.Preview)))
+}
+
+// webSocketOpcodeName returns a readable name for the frame opcode
+func webSocketOpcodeName(opcode byte) string {
+	switch opcode {
+	case wsOpContinuation:
+		return "continuation"
+	case wsOpText:
+		return "text"
+	case wsOpBinary:
+		return "binary"
+	case wsOpClose:
+		return "close"
+	case wsOpPing:
+		return "ping"
+	case wsOpPong:
+		return "pong"
+	}
+	return fmt.Sprintf("0x%x", opcode)
+}
+
+// webSocketPayloadPreview returns the beginning of the frame payload: quoted
+// for text frames, hex-encoded for binary frames, and decoded for close frames
+func webSocketPayloadPreview(f *wsFrame) string {
+	payload := f.Payload
+
+	if f.Opcode == wsOpClose && len(payload) >= 2 {
+		code := binary.BigEndian.Uint16(payload[:2])
+		return strconv.Itoa(int(code)) + " " + strconv.Quote(string(payload[2:]))
+	}
+
+	truncated := len(payload) > wsPreviewLength
+
+	if truncated {
+		payload = payload[:wsPreviewLength]
+	}
+
+	var preview string
+
+	if f.Opcode == wsOpBinary {
+		preview = hex.EncodeToString(payload)
+	} else {
+		preview = strconv.Quote(string(payload))
+	}
+
+	if truncated {
+		preview += "..."
+	}
+
+	return preview
+}
+
+// readWebSocketFrame reads a single frame, unmasking the payload if needed. Frames whose
+// payload exceeds the maximum size are rejected before the payload is read
+func readWebSocketFrame(r *bufio.Reader, maxSize int) (*wsFrame, error) {
+	header := make([]byte, 2)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	f := &wsFrame{
+		Fin:    header[0]&0x80 != 0,
+		Opcode: header[0] & 0x0f,
+		Masked: header[1]&0x80 != 0,
+	}
+
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > uint64(maxSize) {
+		return nil, &wsFrameTooBigError{length: length, maxSize: maxSize}
+	}
+
+	if f.Masked {
+		if _, err := io.ReadFull(r, f.Mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.Payload = make([]byte, length)
+
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+
+	if f.Masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= f.Mask[i%4]
+		}
+	}
+
+	return f, nil
+}
+
+// writeWebSocketFrame writes a single frame, masking the payload if the frame is masked
+func writeWebSocketFrame(w io.Writer, f *wsFrame) error {
+	header := []byte{f.Opcode, 0}
+
+	if f.Fin {
+		header[0] |= 0x80
+	}
+
+	length := len(f.Payload)
+
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	payload := f.Payload
+
+	if f.Masked {
+		header[1] |= 0x80
+		header = append(header, f.Mask[:]...)
+
+		payload = make([]byte, length)
+		for i := range payload {
+			payload[i] = f.Payload[i] ^ f.Mask[i%4]
+		}
+	}
+
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return err
+	}
+
+	return nil
+}
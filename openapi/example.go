@@ -0,0 +1,154 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"sort"
+	"time"
+)
+
+// maxExampleDepth bounds the recursion of the example generation for recursive schemas
+const maxExampleDepth = 8
+
+// Example returns the example value of the media type: the example, the first of the named
+// examples, or a value generated from the schema
+func (doc *Document) Example(media *MediaType) interface{} {
+	if media.Example != nil {
+		return media.Example
+	}
+
+	if len(media.Examples) > 0 {
+		names := make([]string, 0, len(media.Examples))
+
+		for name := range media.Examples {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		return media.Examples[names[0]].Value
+	}
+
+	return doc.Generate(media.Schema)
+}
+
+// Generate returns a value conforming to the schema, using the schema examples, defaults
+// and enumerations where available
+func (doc *Document) Generate(schema *Schema) interface{} {
+	return doc.generate(schema, 0)
+}
+
+// generate returns a value conforming to the schema, at the nesting depth
+func (doc *Document) generate(schema *Schema, depth int) interface{} {
+	schema = doc.Resolve(schema)
+
+	if schema == nil || depth > maxExampleDepth {
+		return nil
+	}
+
+	switch {
+	case schema.Example != nil:
+		return schema.Example
+	case schema.Default != nil:
+		return schema.Default
+	case len(schema.Enum) > 0:
+		return schema.Enum[0]
+	case len(schema.AllOf) > 0:
+		merged := make(map[string]interface{})
+
+		for _, s := range schema.AllOf {
+			if v, ok := doc.generate(s, depth+1).(map[string]interface{}); ok {
+				for name, value := range v {
+					merged[name] = value
+				}
+			}
+		}
+
+		return merged
+	case len(schema.OneOf) > 0:
+		return doc.generate(schema.OneOf[0], depth+1)
+	case len(schema.AnyOf) > 0:
+		return doc.generate(schema.AnyOf[0], depth+1)
+	}
+
+	switch schema.Type {
+	case "string":
+		return generateString(schema)
+	case "integer":
+		if schema.Minimum != nil {
+			return int(*schema.Minimum)
+		}
+		return 0
+	case "number":
+		if schema.Minimum != nil {
+			return *schema.Minimum
+		}
+		return 0.0
+	case "boolean":
+		return true
+	case "array":
+		items := []interface{}{}
+
+		if item := doc.generate(schema.Items, depth+1); item != nil {
+			items = append(items, item)
+		}
+
+		return items
+	}
+
+	// Objects, and schemas with properties but no type
+	object := make(map[string]interface{})
+
+	for name, property := range schema.Properties {
+		if value := doc.generate(property, depth+1); value != nil {
+			object[name] = value
+		}
+	}
+
+	return object
+}
+
+// generateString returns a string conforming to the string schema format and length
+func generateString(schema *Schema) string {
+	var s string
+
+	switch schema.Format {
+	case "date-time":
+		s = time.Now().UTC().Format(time.RFC3339)
+	case "date":
+		s = time.Now().UTC().Format("2006-01-02")
+	case "uuid":
+		s = "3fa85f64-5717-4562-b3fc-2c963f66afa6"
+	case "email":
+		s = "user@example.com"
+	case "uri", "url":
+		s = "https://example.com"
+	case "ipv4":
+		s = "192.0.2.1"
+	default:
+		s = "string"
+	}
+
+	if schema.MinLength != nil {
+		for len(s) < *schema.MinLength {
+			s += "x"
+		}
+	}
+
+	if schema.MaxLength != nil && len(s) > *schema.MaxLength {
+		s = s[:*schema.MaxLength]
+	}
+
+	return s
+}
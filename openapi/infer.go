@@ -0,0 +1,570 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idPattern matches the path segments that look like generated identifiers
+var idPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{8,}$`)
+
+// Exchange is an HTTP request, and its response if one was observed
+type Exchange struct {
+	Method         string
+	URL            string
+	RequestHeader  http.Header
+	RequestBody    string
+	StatusCode     int
+	ResponseHeader http.Header
+	ResponseBody   string
+}
+
+// operationSamples holds the exchanges observed for a single operation
+type operationSamples struct {
+	method     string
+	template   string
+	pathParams map[string][]string
+	exchanges  []Exchange
+}
+
+// Infer builds a draft OpenAPI document describing the observed exchanges: the paths with
+// the inferred parameters, the methods, the query parameters, and the JSON schemas and
+// status codes of the requests and responses
+func Infer(title string, exchanges []Exchange) *Document {
+	doc := &Document{OpenAPI: "3.0.3", Info: Info{Title: title, Version: "1.0.0"}, Paths: make(map[string]*PathItem)}
+
+	samples := make(map[string]*operationSamples)
+
+	for _, exchange := range exchanges {
+		u, err := url.ParseRequestURI(exchange.URL)
+
+		if err != nil || len(exchange.Method) == 0 {
+			continue
+		}
+
+		template, params := inferPathTemplate(u.Path)
+
+		key := exchange.Method + " " + template
+
+		s, ok := samples[key]
+
+		if !ok {
+			s = &operationSamples{method: exchange.Method, template: template, pathParams: make(map[string][]string)}
+			samples[key] = s
+		}
+
+		for i, name := range params.names {
+			s.pathParams[name] = append(s.pathParams[name], params.values[i])
+		}
+
+		s.exchanges = append(s.exchanges, exchange)
+	}
+
+	for _, s := range samples {
+		item, ok := doc.Paths[s.template]
+
+		if !ok {
+			item = &PathItem{}
+			doc.Paths[s.template] = item
+		}
+
+		item.SetOperation(s.method, s.operation())
+	}
+
+	return doc
+}
+
+// pathParameters holds the names and the values of the parameters of a path template
+type pathParameters struct {
+	names  []string
+	values []string
+}
+
+// inferPathTemplate replaces the path segments that look like identifiers with parameters
+// named after the preceding segment, e.g. /orders/42 becomes /orders/{orderId}
+func inferPathTemplate(path string) (string, pathParameters) {
+	var params pathParameters
+
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if !isIdentifier(segment) {
+			continue
+		}
+
+		name := "id"
+
+		if i > 0 && len(segments[i-1]) > 0 && !strings.HasPrefix(segments[i-1], "{") {
+			name = parameterName(segments[i-1])
+		}
+
+		unique := name
+
+		for n := 2; contains(params.names, unique); n++ {
+			unique = fmt.Sprintf("%s%d", name, n)
+		}
+
+		params.names = append(params.names, unique)
+		params.values = append(params.values, segment)
+
+		segments[i] = "{" + unique + "}"
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+// isIdentifier returns true if the path segment is a number, a UUID, or a generated identifier
+func isIdentifier(segment string) bool {
+	if _, err := strconv.ParseInt(segment, 10, 64); err == nil {
+		return true
+	}
+
+	return uuidPattern.MatchString(segment) ||
+		(idPattern.MatchString(segment) && strings.ContainsAny(segment, "0123456789"))
+}
+
+// parameterName derives the parameter name from the collection name, e.g. orders gives orderId
+func parameterName(collection string) string {
+	var name strings.Builder
+
+	upper := false
+
+	for _, c := range collection {
+		if c == '-' || c == '_' || c == '.' {
+			upper = name.Len() > 0
+			continue
+		}
+
+		if upper {
+			name.WriteString(strings.ToUpper(string(c)))
+			upper = false
+		} else {
+			name.WriteRune(c)
+		}
+	}
+
+	singular := name.String()
+
+	switch {
+	case strings.HasSuffix(singular, "ies"):
+		singular = strings.TrimSuffix(singular, "ies") + "y"
+	case strings.HasSuffix(singular, "ss"), strings.HasSuffix(singular, "us"), strings.HasSuffix(singular, "is"):
+	case strings.HasSuffix(singular, "s"):
+		singular = strings.TrimSuffix(singular, "s")
+	}
+
+	if len(singular) == 0 {
+		return "id"
+	}
+
+	return singular + "Id"
+}
+
+// contains returns true if the value is one of the strings
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// operation describes the operation observed in the samples
+func (s *operationSamples) operation() *Operation {
+	op := &Operation{Responses: make(map[string]*Response)}
+
+	names := make([]string, 0, len(s.pathParams))
+
+	for name := range s.pathParams {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name: name, In: "path", Required: true, Schema: inferValuesSchema(s.pathParams[name]),
+		})
+	}
+
+	op.Parameters = append(op.Parameters, s.queryParameters()...)
+
+	var requestBodies, responses int
+
+	for _, exchange := range s.exchanges {
+		if len(exchange.RequestBody) > 0 {
+			if op.RequestBody == nil {
+				op.RequestBody = &RequestBody{Content: make(map[string]*MediaType)}
+			}
+
+			addContent(op.RequestBody.Content, exchange.RequestHeader, exchange.RequestBody)
+			requestBodies++
+		}
+
+		if exchange.StatusCode > 0 {
+			code := strconv.Itoa(exchange.StatusCode)
+
+			resp, ok := op.Responses[code]
+
+			if !ok {
+				resp = &Response{Description: http.StatusText(exchange.StatusCode)}
+
+				if len(resp.Description) == 0 {
+					resp.Description = "Status " + code
+				}
+
+				op.Responses[code] = resp
+			}
+
+			if len(exchange.ResponseBody) > 0 {
+				if resp.Content == nil {
+					resp.Content = make(map[string]*MediaType)
+				}
+
+				addContent(resp.Content, exchange.ResponseHeader, exchange.ResponseBody)
+			}
+
+			responses++
+		}
+	}
+
+	if op.RequestBody != nil {
+		op.RequestBody.Required = requestBodies == len(s.exchanges)
+		completeContent(op.RequestBody.Content)
+	}
+
+	for _, resp := range op.Responses {
+		completeContent(resp.Content)
+	}
+
+	// An operation declares at least one response
+	if responses == 0 {
+		op.Responses["default"] = &Response{Description: "No response was observed"}
+	}
+
+	return op
+}
+
+// queryParameters describes the query parameters observed in the samples, which are
+// required if they are present in all the requests
+func (s *operationSamples) queryParameters() []*Parameter {
+	values := make(map[string][]string)
+	occurrences := make(map[string]int)
+	repeated := make(map[string]bool)
+
+	for _, exchange := range s.exchanges {
+		u, _ := url.ParseRequestURI(exchange.URL)
+
+		for name, v := range u.Query() {
+			values[name] = append(values[name], v...)
+			occurrences[name]++
+			repeated[name] = repeated[name] || len(v) > 1
+		}
+	}
+
+	names := make([]string, 0, len(values))
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var params []*Parameter
+
+	for _, name := range names {
+		schema := inferValuesSchema(values[name])
+
+		if repeated[name] {
+			schema = &Schema{Type: "array", Items: schema}
+		}
+
+		params = append(params, &Parameter{
+			Name: name, In: "query", Required: occurrences[name] == len(s.exchanges), Schema: schema,
+		})
+	}
+
+	return params
+}
+
+// addContent merges the body into the media type of its content type. JSON bodies are
+// described by the inferred schema, with the first body as the example
+func addContent(content map[string]*MediaType, header http.Header, body string) {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	media, ok := content[mediaType]
+
+	if !ok {
+		media = &MediaType{}
+		content[mediaType] = media
+	}
+
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		if media.Schema == nil {
+			media.Schema = &Schema{Type: "string"}
+		}
+		return
+	}
+
+	var value interface{}
+
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return
+	}
+
+	if media.Example == nil {
+		media.Example = value
+	}
+
+	media.Schema = mergeSchemas(media.Schema, inferSchema(value))
+}
+
+// inferValuesSchema returns the schema of the path or query parameter values
+func inferValuesSchema(values []string) *Schema {
+	var schema *Schema
+
+	for _, v := range values {
+		var s *Schema
+
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			s = &Schema{Type: "integer"}
+		} else if _, err := strconv.ParseFloat(v, 64); err == nil {
+			s = &Schema{Type: "number"}
+		} else if v == "true" || v == "false" {
+			s = &Schema{Type: "boolean"}
+		} else {
+			s = &Schema{Type: "string", Format: inferFormat(v)}
+		}
+
+		if schema != nil && !compatibleTypes(schema.Type, s.Type) {
+			return &Schema{Type: "string"}
+		}
+
+		schema = mergeSchemas(schema, s)
+	}
+
+	return schema
+}
+
+// inferSchema returns the schema of the decoded JSON value
+func inferSchema(value interface{}) *Schema {
+	switch v := value.(type) {
+	case nil:
+		return &Schema{Nullable: true}
+	case bool:
+		return &Schema{Type: "boolean"}
+	case float64:
+		if v == math.Trunc(v) {
+			return &Schema{Type: "integer"}
+		}
+		return &Schema{Type: "number"}
+	case string:
+		return &Schema{Type: "string", Format: inferFormat(v)}
+	case []interface{}:
+		schema := &Schema{Type: "array"}
+
+		for _, item := range v {
+			schema.Items = mergeSchemas(schema.Items, inferSchema(item))
+		}
+
+		return schema
+	case map[string]interface{}:
+		schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+
+		for name, property := range v {
+			schema.Properties[name] = inferSchema(property)
+			schema.Required = append(schema.Required, name)
+		}
+
+		sort.Strings(schema.Required)
+
+		return schema
+	}
+
+	return &Schema{}
+}
+
+// inferFormat returns the format of the string: date-time, date, uuid, or none
+func inferFormat(s string) string {
+	if _, err := time.Parse(time.RFC3339, s); err == nil {
+		return "date-time"
+	}
+
+	if _, err := time.Parse("2006-01-02", s); err == nil {
+		return "date"
+	}
+
+	if uuidPattern.MatchString(s) {
+		return "uuid"
+	}
+
+	return ""
+}
+
+// mergeSchemas returns the schema describing the values of both schemas. The properties
+// of the objects are required only if both schemas require them, and the values of
+// different types are described by the alternatives of anyOf
+func mergeSchemas(a, b *Schema) *Schema {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case isNullSchema(a):
+		return nullableSchema(b)
+	case isNullSchema(b):
+		return nullableSchema(a)
+	case len(a.AnyOf) > 0 || len(b.AnyOf) > 0 || !compatibleTypes(a.Type, b.Type):
+		return mergeAlternatives(a, b)
+	}
+
+	merged := &Schema{Type: a.Type, Nullable: a.Nullable || b.Nullable}
+
+	switch a.Type {
+	case "integer", "number":
+		if b.Type == "number" {
+			merged.Type = "number"
+		}
+	case "string":
+		if a.Format == b.Format {
+			merged.Format = a.Format
+		}
+	case "array":
+		merged.Items = mergeSchemas(a.Items, b.Items)
+	case "object":
+		merged.Properties = make(map[string]*Schema)
+
+		for name, property := range a.Properties {
+			merged.Properties[name] = mergeSchemas(property, b.Properties[name])
+		}
+
+		for name, property := range b.Properties {
+			if _, ok := merged.Properties[name]; !ok {
+				merged.Properties[name] = property
+			}
+		}
+
+		for _, name := range a.Required {
+			if contains(b.Required, name) {
+				merged.Required = append(merged.Required, name)
+			}
+		}
+	}
+
+	return merged
+}
+
+// mergeAlternatives returns the anyOf schema of the alternatives of both schemas,
+// merging the alternatives of compatible types
+func mergeAlternatives(a, b *Schema) *Schema {
+	var alternatives []*Schema
+
+	for _, s := range [][]*Schema{schemaAlternatives(a), schemaAlternatives(b)} {
+		for _, alternative := range s {
+			merged := false
+
+			for i, existing := range alternatives {
+				if compatibleTypes(existing.Type, alternative.Type) {
+					alternatives[i] = mergeSchemas(existing, alternative)
+					merged = true
+					break
+				}
+			}
+
+			if !merged {
+				alternatives = append(alternatives, alternative)
+			}
+		}
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+
+	return &Schema{AnyOf: alternatives, Nullable: a.Nullable || b.Nullable}
+}
+
+// schemaAlternatives returns the anyOf alternatives of the schema, or the schema itself
+func schemaAlternatives(s *Schema) []*Schema {
+	if len(s.AnyOf) > 0 {
+		return s.AnyOf
+	}
+
+	return []*Schema{s}
+}
+
+// compatibleTypes returns true if the values of both types are described by a single schema
+func compatibleTypes(a, b string) bool {
+	return a == b || ((a == "integer" || a == "number") && (b == "integer" || b == "number"))
+}
+
+// isNullSchema returns true if the schema only describes the null value
+func isNullSchema(s *Schema) bool {
+	return s.Nullable && len(s.Type) == 0 && len(s.AnyOf) == 0
+}
+
+// nullableSchema returns a nullable copy of the schema
+func nullableSchema(s *Schema) *Schema {
+	nullable := *s
+	nullable.Nullable = true
+
+	return &nullable
+}
+
+// completeContent completes the schemas of the media types once all the bodies are merged
+func completeContent(content map[string]*MediaType) {
+	for _, media := range content {
+		completeSchema(media.Schema)
+	}
+}
+
+// completeSchema declares the items of the arrays without observed items as any value
+func completeSchema(s *Schema) *Schema {
+	if s == nil {
+		return nil
+	}
+
+	if s.Type == "array" && s.Items == nil {
+		s.Items = &Schema{}
+	}
+
+	completeSchema(s.Items)
+
+	for _, property := range s.Properties {
+		completeSchema(property)
+	}
+
+	for _, alternative := range s.AnyOf {
+		completeSchema(alternative)
+	}
+
+	return s
+}
@@ -0,0 +1,312 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openapi implements the subset of the OpenAPI 3 specification httpr needs
+// to mock, validate and describe HTTP APIs
+package openapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// schemaRefPrefix is the prefix of the references to the component schemas
+const schemaRefPrefix = "#/components/schemas/"
+
+// Document is an OpenAPI document
+type Document struct {
+	OpenAPI    string               `yaml:"openapi" json:"openapi"`
+	Info       Info                 `yaml:"info" json:"info"`
+	Paths      map[string]*PathItem `yaml:"paths" json:"paths"`
+	Components *Components          `yaml:"components,omitempty" json:"components,omitempty"`
+}
+
+// Info describes the API
+type Info struct {
+	Title   string `yaml:"title" json:"title"`
+	Version string `yaml:"version" json:"version"`
+}
+
+// Components holds the reusable schemas
+type Components struct {
+	Schemas map[string]*Schema `yaml:"schemas,omitempty" json:"schemas,omitempty"`
+}
+
+// PathItem describes the operations available on a path
+type PathItem struct {
+	Parameters []*Parameter `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+	Get        *Operation   `yaml:"get,omitempty" json:"get,omitempty"`
+	Put        *Operation   `yaml:"put,omitempty" json:"put,omitempty"`
+	Post       *Operation   `yaml:"post,omitempty" json:"post,omitempty"`
+	Delete     *Operation   `yaml:"delete,omitempty" json:"delete,omitempty"`
+	Options    *Operation   `yaml:"options,omitempty" json:"options,omitempty"`
+	Head       *Operation   `yaml:"head,omitempty" json:"head,omitempty"`
+	Patch      *Operation   `yaml:"patch,omitempty" json:"patch,omitempty"`
+	Trace      *Operation   `yaml:"trace,omitempty" json:"trace,omitempty"`
+}
+
+// Operation describes a single API operation on a path
+type Operation struct {
+	OperationID string               `yaml:"operationId,omitempty" json:"operationId,omitempty"`
+	Parameters  []*Parameter         `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+	RequestBody *RequestBody         `yaml:"requestBody,omitempty" json:"requestBody,omitempty"`
+	Responses   map[string]*Response `yaml:"responses" json:"responses"`
+}
+
+// Parameter describes a single operation parameter
+type Parameter struct {
+	Name     string  `yaml:"name" json:"name"`
+	In       string  `yaml:"in" json:"in"`
+	Required bool    `yaml:"required,omitempty" json:"required,omitempty"`
+	Schema   *Schema `yaml:"schema,omitempty" json:"schema,omitempty"`
+}
+
+// RequestBody describes the request body of an operation
+type RequestBody struct {
+	Required bool                  `yaml:"required,omitempty" json:"required,omitempty"`
+	Content  map[string]*MediaType `yaml:"content" json:"content"`
+}
+
+// Response describes a single response of an operation
+type Response struct {
+	Description string                `yaml:"description" json:"description"`
+	Content     map[string]*MediaType `yaml:"content,omitempty" json:"content,omitempty"`
+}
+
+// MediaType describes the content of a request or response body
+type MediaType struct {
+	Schema   *Schema             `yaml:"schema,omitempty" json:"schema,omitempty"`
+	Example  interface{}         `yaml:"example,omitempty" json:"example,omitempty"`
+	Examples map[string]*Example `yaml:"examples,omitempty" json:"examples,omitempty"`
+}
+
+// Example is a named example of a media type
+type Example struct {
+	Summary string      `yaml:"summary,omitempty" json:"summary,omitempty"`
+	Value   interface{} `yaml:"value,omitempty" json:"value,omitempty"`
+}
+
+// Schema is a JSON Schema, as supported by OpenAPI 3.0
+type Schema struct {
+	Ref                  string             `yaml:"$ref,omitempty" json:"$ref,omitempty"`
+	Type                 string             `yaml:"type,omitempty" json:"type,omitempty"`
+	Format               string             `yaml:"format,omitempty" json:"format,omitempty"`
+	Nullable             bool               `yaml:"nullable,omitempty" json:"nullable,omitempty"`
+	Enum                 []interface{}      `yaml:"enum,omitempty" json:"enum,omitempty"`
+	Default              interface{}        `yaml:"default,omitempty" json:"default,omitempty"`
+	Example              interface{}        `yaml:"example,omitempty" json:"example,omitempty"`
+	Properties           map[string]*Schema `yaml:"properties,omitempty" json:"properties,omitempty"`
+	Required             []string           `yaml:"required,omitempty" json:"required,omitempty"`
+	AdditionalProperties *bool              `yaml:"additionalProperties,omitempty" json:"additionalProperties,omitempty"`
+	Items                *Schema            `yaml:"items,omitempty" json:"items,omitempty"`
+	AllOf                []*Schema          `yaml:"allOf,omitempty" json:"allOf,omitempty"`
+	OneOf                []*Schema          `yaml:"oneOf,omitempty" json:"oneOf,omitempty"`
+	AnyOf                []*Schema          `yaml:"anyOf,omitempty" json:"anyOf,omitempty"`
+	Minimum              *float64           `yaml:"minimum,omitempty" json:"minimum,omitempty"`
+	Maximum              *float64           `yaml:"maximum,omitempty" json:"maximum,omitempty"`
+	MinLength            *int               `yaml:"minLength,omitempty" json:"minLength,omitempty"`
+	MaxLength            *int               `yaml:"maxLength,omitempty" json:"maxLength,omitempty"`
+	Pattern              string             `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	MinItems             *int               `yaml:"minItems,omitempty" json:"minItems,omitempty"`
+	MaxItems             *int               `yaml:"maxItems,omitempty" json:"maxItems,omitempty"`
+}
+
+// Load reads the OpenAPI document from a YAML or JSON file
+func Load(fileName string) (*Document, error) {
+	data, err := ioutil.ReadFile(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse parses the YAML or JSON OpenAPI document
+func Parse(data []byte) (*Document, error) {
+	var doc Document
+
+	// JSON is a subset of YAML
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version: %q", doc.OpenAPI)
+	}
+
+	return &doc, nil
+}
+
+// Operations returns the operations of the path item, keyed by the HTTP method
+func (item *PathItem) Operations() map[string]*Operation {
+	ops := make(map[string]*Operation)
+
+	for method, op := range map[string]*Operation{
+		"GET": item.Get, "PUT": item.Put, "POST": item.Post, "DELETE": item.Delete,
+		"OPTIONS": item.Options, "HEAD": item.Head, "PATCH": item.Patch, "TRACE": item.Trace,
+	} {
+		if op != nil {
+			ops[method] = op
+		}
+	}
+
+	return ops
+}
+
+// SetOperation sets the operation of the path item for the HTTP method
+func (item *PathItem) SetOperation(method string, op *Operation) {
+	switch strings.ToUpper(method) {
+	case "GET":
+		item.Get = op
+	case "PUT":
+		item.Put = op
+	case "POST":
+		item.Post = op
+	case "DELETE":
+		item.Delete = op
+	case "OPTIONS":
+		item.Options = op
+	case "HEAD":
+		item.Head = op
+	case "PATCH":
+		item.Patch = op
+	case "TRACE":
+		item.Trace = op
+	}
+}
+
+// Resolve follows the schema reference to the component schema, if the schema is a reference
+func (doc *Document) Resolve(schema *Schema) *Schema {
+	for i := 0; schema != nil && len(schema.Ref) > 0 && i < 16; i++ {
+		if doc.Components == nil || !strings.HasPrefix(schema.Ref, schemaRefPrefix) {
+			return nil
+		}
+
+		schema = doc.Components.Schemas[strings.TrimPrefix(schema.Ref, schemaRefPrefix)]
+	}
+
+	return schema
+}
+
+// Route is an operation matched by a request
+type Route struct {
+	Path       string
+	PathItem   *PathItem
+	Operation  *Operation
+	PathParams map[string]string
+}
+
+// Match finds the path template matching the request path, preferring the templates with
+// the fewest parameters, e.g. /pets/mine over /pets/{id}, and the operation for the method.
+// The route is nil if no path matches; its operation is nil if the method is not declared
+func (doc *Document) Match(method, path string) *Route {
+	var best *Route
+
+	for _, template := range doc.sortedPaths() {
+		params, ok := MatchPath(template, path)
+
+		if ok && (best == nil || len(params) < len(best.PathParams)) {
+			item := doc.Paths[template]
+			best = &Route{Path: template, PathItem: item, Operation: item.Operations()[method], PathParams: params}
+		}
+	}
+
+	return best
+}
+
+// sortedPaths returns the path templates in a stable order
+func (doc *Document) sortedPaths() []string {
+	paths := make([]string, 0, len(doc.Paths))
+
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// MatchPath matches the request path against the path template, returning the path parameters
+func MatchPath(template, path string) (map[string]string, bool) {
+	templateSegments := strings.Split(strings.Trim(template, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+
+	if len(templateSegments) != len(pathSegments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if len(pathSegments[i]) == 0 {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = pathSegments[i]
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// LoadSchema reads a JSON Schema from a YAML or JSON file
+func LoadSchema(fileName string) (*Schema, error) {
+	data, err := ioutil.ReadFile(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var schema Schema
+
+	if err := yaml.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	return &schema, nil
+}
+
+// SetRequestSchema declares the JSON request body schema of the operation on the path,
+// adding the path and the operation to the document as needed
+func (doc *Document) SetRequestSchema(method, path string, schema *Schema) {
+	if doc.Paths == nil {
+		doc.Paths = make(map[string]*PathItem)
+	}
+
+	item, ok := doc.Paths[path]
+
+	if !ok {
+		item = &PathItem{}
+		doc.Paths[path] = item
+	}
+
+	op := item.Operations()[strings.ToUpper(method)]
+
+	if op == nil {
+		op = &Operation{}
+		item.SetOperation(method, op)
+	}
+
+	op.RequestBody = &RequestBody{
+		Required: true,
+		Content:  map[string]*MediaType{"application/json": {Schema: schema}},
+	}
+}
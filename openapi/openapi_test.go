@@ -0,0 +1,259 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const testSpec = `
+openapi: 3.0.3
+info:
+  title: Pets
+  version: "1.0"
+paths:
+  /pets/{id}:
+    get:
+      responses:
+        "200":
+          description: A pet
+  /pets/mine:
+    get:
+      responses:
+        "200":
+          description: My pet
+    delete:
+      responses:
+        "204":
+          description: Deleted
+components:
+  schemas:
+    Pet:
+      type: object
+      properties:
+        id: {type: integer, minimum: 1}
+        name: {type: string, minLength: 8}
+        tag: {type: string, enum: [dog, cat]}
+        tags: {type: array, items: {type: string, example: friendly}}
+        parent: {$ref: "#/components/schemas/Pet"}
+`
+
+func TestParse(t *testing.T) {
+	if _, err := Parse([]byte(`swagger: "2.0"`)); err == nil {
+		t.Error("Expected an error for a Swagger 2.0 document")
+	}
+
+	doc, err := Parse([]byte(testSpec))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Info.Title != "Pets" || len(doc.Paths) != 2 || len(doc.Paths["/pets/mine"].Operations()) != 2 {
+		t.Errorf("Unexpected document: %+v", doc)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	doc, _ := Parse([]byte(testSpec))
+
+	tests := []struct {
+		method             string
+		path               string
+		expectedPath       string
+		expectedOperation  bool
+		expectedPathParams map[string]string
+	}{
+		{"GET", "/pets/42", "/pets/{id}", true, map[string]string{"id": "42"}},
+		{"GET", "/pets/mine", "/pets/mine", true, map[string]string{}},
+		{"DELETE", "/pets/42", "/pets/{id}", false, map[string]string{"id": "42"}},
+		{"GET", "/pets", "", false, nil},
+	}
+
+	for _, test := range tests {
+		route := doc.Match(test.method, test.path)
+
+		if route == nil {
+			if len(test.expectedPath) > 0 {
+				t.Errorf("Expected %s %s to match %s", test.method, test.path, test.expectedPath)
+			}
+			continue
+		}
+
+		if route.Path != test.expectedPath || (route.Operation != nil) != test.expectedOperation ||
+			!reflect.DeepEqual(route.PathParams, test.expectedPathParams) {
+			t.Errorf("Unexpected route for %s %s: %+v", test.method, test.path, route)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	doc, _ := Parse([]byte(testSpec))
+
+	value, ok := doc.Generate(&Schema{Ref: "#/components/schemas/Pet"}).(map[string]interface{})
+
+	if !ok {
+		t.Fatalf("Expected an object, got %v", value)
+	}
+
+	if value["id"] != 1 || value["name"] != "stringxx" || value["tag"] != "dog" ||
+		!reflect.DeepEqual(value["tags"], []interface{}{"friendly"}) {
+		t.Errorf("Unexpected generated value: %v", value)
+	}
+
+	// Recursive schemas are generated up to a maximum depth
+	if _, ok := value["parent"].(map[string]interface{}); !ok {
+		t.Errorf("Expected the recursive property to be generated, got %v", value["parent"])
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	doc, err := Parse([]byte(`
+openapi: 3.0.3
+info: {title: Orders, version: "1.0"}
+paths:
+  /orders/{id}:
+    put:
+      parameters:
+        - {name: id, in: path, required: true, schema: {type: integer, minimum: 1}}
+        - {name: dryRun, in: query, schema: {type: boolean}}
+        - {name: X-Request-Id, in: header, required: true, schema: {type: string, format: uuid}}
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema: {$ref: "#/components/schemas/Order"}
+      responses:
+        "200": {description: Updated}
+components:
+  schemas:
+    Order:
+      type: object
+      required: [item, quantity]
+      additionalProperties: false
+      properties:
+        item: {type: string, minLength: 1}
+        quantity: {type: integer, minimum: 1, maximum: 10}
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path           string
+		header         string
+		body           string
+		expectedErrors []string
+	}{
+		{"/orders/1?dryRun=true", "7f1c7f0e-8b7a-4c55-9a5e-2f5a3c4d5e6f", `{"item":"book","quantity":2}`, nil},
+		{"/orders/0?dryRun=maybe", "", `{"quantity":20,"color":"red"}`, []string{
+			"path.id: 0 is less than the minimum 1",
+			`query.dryRun: expected boolean, got "maybe"`,
+			"header.X-Request-Id: required",
+			"body.item: required",
+			"body.color: unexpected property",
+			"body.quantity: 20 is greater than the maximum 10",
+		}},
+		{"/orders/1", "not-a-uuid", `{"item":`, []string{
+			`header.X-Request-Id: "not-a-uuid" is not a valid uuid`,
+			"body: invalid JSON: unexpected end of JSON input",
+		}},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("PUT", test.path, nil)
+		req.Header.Set("Content-Type", "application/json")
+
+		if len(test.header) > 0 {
+			req.Header.Set("X-Request-Id", test.header)
+		}
+
+		errs := doc.ValidateRequest(doc.Match("PUT", req.URL.Path), req, []byte(test.body))
+
+		if !reflect.DeepEqual(errs, test.expectedErrors) {
+			t.Errorf("Unexpected validation errors for %s %s:\n%q\nexpected:\n%q", test.path, test.body, errs, test.expectedErrors)
+		}
+	}
+}
+
+func TestInfer(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+
+	doc := Infer("Orders", []Exchange{
+		{Method: "GET", URL: "/orders/42?expand=true", StatusCode: 200, ResponseHeader: jsonHeader, ResponseBody: `{"id":42,"tags":[]}`},
+		{Method: "GET", URL: "/orders/43", StatusCode: 200, ResponseHeader: jsonHeader, ResponseBody: `{"id":43,"tags":["new"],"note":null}`},
+		{Method: "GET", URL: "/orders/44", StatusCode: 404},
+		{Method: "POST", URL: "/orders", RequestHeader: jsonHeader, RequestBody: `{"item":"book","price":9.5}`},
+		{Method: "POST", URL: "/orders", RequestHeader: jsonHeader, RequestBody: `{"item":"pen","price":2}`},
+	})
+
+	if len(doc.Paths) != 2 || doc.Paths["/orders/{orderId}"] == nil || doc.Paths["/orders"] == nil {
+		t.Fatalf("Unexpected paths: %v", doc.Paths)
+	}
+
+	get := doc.Paths["/orders/{orderId}"].Get
+
+	expectedParams := []*Parameter{
+		{Name: "orderId", In: "path", Required: true, Schema: &Schema{Type: "integer"}},
+		{Name: "expand", In: "query", Schema: &Schema{Type: "boolean"}},
+	}
+
+	if !reflect.DeepEqual(get.Parameters, expectedParams) {
+		t.Errorf("Unexpected parameters: %+v", get.Parameters)
+	}
+
+	if len(get.Responses) != 2 || get.Responses["404"].Description != "Not Found" {
+		t.Errorf("Unexpected responses: %+v", get.Responses)
+	}
+
+	expectedSchema := &Schema{Type: "object", Required: []string{"id", "tags"}, Properties: map[string]*Schema{
+		"id":   {Type: "integer"},
+		"tags": {Type: "array", Items: &Schema{Type: "string"}},
+		"note": {Nullable: true},
+	}}
+
+	if schema := get.Responses["200"].Content["application/json"].Schema; !reflect.DeepEqual(schema, expectedSchema) {
+		t.Errorf("Unexpected response schema: %+v", schema)
+	}
+
+	post := doc.Paths["/orders"].Post
+
+	if !post.RequestBody.Required || post.Responses["default"] == nil {
+		t.Errorf("Unexpected operation: %+v", post)
+	}
+
+	if price := post.RequestBody.Content["application/json"].Schema.Properties["price"]; price.Type != "number" {
+		t.Errorf("Expected a number, got %+v", price)
+	}
+}
+
+func TestInferPathTemplate(t *testing.T) {
+	tests := map[string]string{
+		"/users/7/order-items/9":                           "/users/{userId}/order-items/{orderItemId}",
+		"/categories/5f1c7f0e-8b7a-4c55-9a5e-2f5a3c4d5e6f": "/categories/{categoryId}",
+		"/status/500":        "/status/{statusId}",
+		"/42/1":              "/{id}/{id2}",
+		"/v2/orders/pending": "/v2/orders/pending",
+	}
+
+	for path, expected := range tests {
+		if template, _ := inferPathTemplate(path); template != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, path, template)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright © 2017 Igor Bondarenko <ibondare@protonmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// uuidPattern matches the uuid string format
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidateRequest validates the path, query and header parameters, and the body
+// of the request against the operation of the route, and returns the validation errors
+func (doc *Document) ValidateRequest(route *Route, r *http.Request, body []byte) []string {
+	var errs []string
+
+	for _, param := range route.parameters() {
+		var values []string
+
+		switch param.In {
+		case "path":
+			if v, ok := route.PathParams[param.Name]; ok {
+				values = []string{v}
+			}
+		case "query":
+			values = r.URL.Query()[param.Name]
+		case "header":
+			values = r.Header.Values(param.Name)
+		default:
+			continue
+		}
+
+		path := param.In + "." + param.Name
+
+		if len(values) == 0 {
+			if param.Required {
+				errs = append(errs, fmt.Sprintf("%s: required", path))
+			}
+			continue
+		}
+
+		value, err := doc.parseParameter(param.Schema, values)
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+
+		errs = append(errs, doc.ValidateValue(param.Schema, value, path)...)
+	}
+
+	if rb := route.Operation.RequestBody; rb != nil {
+		errs = append(errs, doc.validateBody(rb, r.Header.Get("Content-Type"), body)...)
+	}
+
+	return errs
+}
+
+// parameters returns the parameters of the operation, including the path item
+// parameters not overridden by the operation
+func (route *Route) parameters() []*Parameter {
+	params := append([]*Parameter{}, route.Operation.Parameters...)
+
+	for _, param := range route.PathItem.Parameters {
+		overridden := false
+
+		for _, p := range route.Operation.Parameters {
+			overridden = overridden || (p.Name == param.Name && p.In == param.In)
+		}
+
+		if !overridden {
+			params = append(params, param)
+		}
+	}
+
+	return params
+}
+
+// parseParameter converts the parameter values to the type of the schema
+func (doc *Document) parseParameter(schema *Schema, values []string) (interface{}, error) {
+	schema = doc.Resolve(schema)
+
+	if schema == nil {
+		return values[0], nil
+	}
+
+	if schema.Type == "array" {
+		// Arrays are either repeated or comma-separated
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+
+		items := make([]interface{}, len(values))
+
+		for i, v := range values {
+			item, err := doc.parseParameter(schema.Items, []string{v})
+
+			if err != nil {
+				return nil, err
+			}
+
+			items[i] = item
+		}
+
+		return items, nil
+	}
+
+	switch schema.Type {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(values[0], 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("expected %s, got %q", schema.Type, values[0])
+		}
+
+		return n, nil
+	case "boolean":
+		b, err := strconv.ParseBool(values[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("expected boolean, got %q", values[0])
+		}
+
+		return b, nil
+	}
+
+	return values[0], nil
+}
+
+// validateBody validates the request body against the media type of its content type
+func (doc *Document) validateBody(rb *RequestBody, contentType string, body []byte) []string {
+	if len(body) == 0 {
+		if rb.Required {
+			return []string{"body: required"}
+		}
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	media, ok := rb.Content[mediaType]
+
+	if !ok {
+		for declared, m := range rb.Content {
+			if declared == "*/*" || (strings.HasSuffix(declared, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(declared, "*"))) {
+				media, ok = m, true
+			}
+		}
+	}
+
+	if !ok {
+		return []string{fmt.Sprintf("body: unsupported content type %q", contentType)}
+	}
+
+	if media.Schema == nil || !(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	var value interface{}
+
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("body: invalid JSON: %v", err)}
+	}
+
+	return doc.ValidateValue(media.Schema, value, "body")
+}
+
+// ValidateValue validates the decoded JSON value against the schema, and returns
+// the validation errors, prefixed by the path of the invalid values
+func (doc *Document) ValidateValue(schema *Schema, value interface{}, path string) []string {
+	schema = doc.Resolve(schema)
+
+	if schema == nil {
+		return nil
+	}
+
+	var errs []string
+
+	for _, s := range schema.AllOf {
+		errs = append(errs, doc.ValidateValue(s, value, path)...)
+	}
+
+	if len(schema.AnyOf) > 0 && doc.countMatches(schema.AnyOf, value, path) == 0 {
+		errs = append(errs, fmt.Sprintf("%s: does not match any of the schemas", path))
+	}
+
+	if n := doc.countMatches(schema.OneOf, value, path); len(schema.OneOf) > 0 && n != 1 {
+		errs = append(errs, fmt.Sprintf("%s: matches %d of the schemas instead of exactly one", path, n))
+	}
+
+	if value == nil {
+		if len(schema.Type) > 0 && !schema.Nullable {
+			errs = append(errs, fmt.Sprintf("%s: expected %s, got null", path, schema.Type))
+		}
+		return errs
+	}
+
+	if len(schema.Enum) > 0 && !enumContains(schema.Enum, value) {
+		errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, schema.Enum))
+	}
+
+	if len(schema.Type) > 0 && !typeMatches(schema.Type, value) {
+		return append(errs, fmt.Sprintf("%s: expected %s, got %s", path, schema.Type, typeName(value)))
+	}
+
+	switch v := value.(type) {
+	case string:
+		errs = append(errs, validateString(schema, v, path)...)
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: %v is less than the minimum %v", path, v, *schema.Minimum))
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			errs = append(errs, fmt.Sprintf("%s: %v is greater than the maximum %v", path, v, *schema.Maximum))
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			errs = append(errs, fmt.Sprintf("%s: expected at least %d items, got %d", path, *schema.MinItems, len(v)))
+		}
+		if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+			errs = append(errs, fmt.Sprintf("%s: expected at most %d items, got %d", path, *schema.MaxItems, len(v)))
+		}
+		for i, item := range v {
+			errs = append(errs, doc.ValidateValue(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case map[string]interface{}:
+		errs = append(errs, doc.validateObject(schema, v, path)...)
+	}
+
+	return errs
+}
+
+// countMatches returns the number of schemas the value is valid against
+func (doc *Document) countMatches(schemas []*Schema, value interface{}, path string) int {
+	n := 0
+
+	for _, s := range schemas {
+		if len(doc.ValidateValue(s, value, path)) == 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// validateObject validates the required and the declared properties of the object
+func (doc *Document) validateObject(schema *Schema, object map[string]interface{}, path string) []string {
+	var errs []string
+
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			errs = append(errs, fmt.Sprintf("%s.%s: required", path, name))
+		}
+	}
+
+	names := make([]string, 0, len(object))
+
+	for name := range object {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if property, ok := schema.Properties[name]; ok {
+			errs = append(errs, doc.ValidateValue(property, object[name], path+"."+name)...)
+		} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+			errs = append(errs, fmt.Sprintf("%s.%s: unexpected property", path, name))
+		}
+	}
+
+	return errs
+}
+
+// validateString validates the length, the pattern and the format of the string
+func validateString(schema *Schema, s string, path string) []string {
+	var errs []string
+
+	length := utf8.RuneCountInString(s)
+
+	if schema.MinLength != nil && length < *schema.MinLength {
+		errs = append(errs, fmt.Sprintf("%s: expected at least %d characters, got %d", path, *schema.MinLength, length))
+	}
+
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		errs = append(errs, fmt.Sprintf("%s: expected at most %d characters, got %d", path, *schema.MaxLength, length))
+	}
+
+	if len(schema.Pattern) > 0 {
+		if re, err := regexp.Compile(schema.Pattern); err == nil && !re.MatchString(s) {
+			errs = append(errs, fmt.Sprintf("%s: %q does not match the pattern %s", path, s, schema.Pattern))
+		}
+	}
+
+	var valid bool
+
+	switch schema.Format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		valid = err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		valid = err == nil
+	case "uuid":
+		valid = uuidPattern.MatchString(s)
+	case "email":
+		valid = strings.Contains(s, "@")
+	default:
+		valid = true
+	}
+
+	if !valid {
+		errs = append(errs, fmt.Sprintf("%s: %q is not a valid %s", path, s, schema.Format))
+	}
+
+	return errs
+}
+
+// typeMatches reports whether the decoded JSON value is of the schema type
+func typeMatches(schemaType string, value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return schemaType == "string"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && v == math.Trunc(v))
+	case bool:
+		return schemaType == "boolean"
+	case []interface{}:
+		return schemaType == "array"
+	case map[string]interface{}:
+		return schemaType == "object"
+	}
+
+	return false
+}
+
+// typeName returns the JSON type name of the decoded JSON value
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
+
+// enumContains reports whether the value is one of the enumerated values,
+// comparing the numbers regardless of their Go type
+func enumContains(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(normalizeNumber(e), normalizeNumber(value)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeNumber converts the integers decoded from YAML to float64, as decoded from JSON
+func normalizeNumber(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+
+	return value
+}